@@ -1,13 +1,46 @@
 package swim
 
+import (
+	"time"
+)
+
+// The reason a broadcast was removed from the broadcast queue.
+type BroadcastReason int
+
+const (
+	BroadcastDelivered  BroadcastReason = iota // Reached the transmission limit
+	BroadcastSuperseded                        // Invalidated by, or not queued over, a newer broadcast
+	BroadcastEvicted                           // Evicted or dropped from a full queue
+	BroadcastStopped                           // The detector stopped
+	BroadcastExpired                           // Reached the expiry time
+)
+
+// The result of a broadcast, sent on the done channel of the broadcast.
+type BroadcastResult struct {
+	Reason BroadcastReason // Why the broadcast was removed
+	Nodes  int             // Number of distinct nodes the broadcast was sent to
+}
+
+// Options for queueing a broadcast. The zero value queues a broadcast as
+// Broker.Broadcast does.
+type BroadcastOptions struct {
+	Class          uint      // Priority class, at least the default class 2
+	RetransmitMult uint      // Retransmit multiplier, or 0 for the default
+	Expiry         time.Time // Time after which not to send, or zero for none
+}
+
 // A broadcast describes an event to be broadcast to the group.
 type Broadcast struct {
-	Class    uint                // Priority class of the broadcast
-	Attempts uint                // Number of transmissions attempted
-	Event    BroadcastEvent      // The event to broadcast
-	Done     chan struct{}       // The channel on which to signal done
-	State    map[uint64]struct{} // For avoiding sending to the same node
+	Class    uint                 // Priority class of the broadcast
+	Attempts uint                 // Number of transmissions attempted
+	Event    BroadcastEvent       // The event to broadcast
+	Done     chan BroadcastResult // The channel on which to signal done
+	State    map[uint64]struct{}  // For avoiding sending to the same node
+	Mult     uint                 // Retransmit multiplier, or 0 for the default
+	Expiry   time.Time            // Time after which not to send, or zero for none
 	order    int
+	index    int // Index in the broadcast queue heap
+	evict    int // Index in the eviction heap
 }
 
 // Calculate the overall priority for the broadcast. Broadcasts with lower
@@ -23,6 +56,11 @@ func (b *Broadcast) Priority() uint {
 	return b.Class * b.Attempts
 }
 
+// Determine if the broadcast has expired at the given time.
+func (b *Broadcast) Expired(now time.Time) bool {
+	return !b.Expiry.IsZero() && now.After(b.Expiry)
+}
+
 // Determine if this broadcast invalidates that broadcast.
 func (b *Broadcast) Invalidates(that *Broadcast) bool {
 	ltag := b.Event.Tag()
@@ -45,3 +83,18 @@ func (b *Broadcast) Invalidates(that *Broadcast) bool {
 	}
 	return false
 }
+
+// Signal the result of the broadcast on the done channel, if any.
+func (b *Broadcast) finish(reason BroadcastReason) {
+	if b.Done == nil {
+		return
+	}
+
+	// count the nodes sent to, excluding the source
+	nodes := len(b.State)
+	if _, ok := b.State[b.Event.Source()]; ok {
+		nodes -= 1
+	}
+
+	b.Done <- BroadcastResult{Reason: reason, Nodes: nodes}
+}
@@ -1,21 +1,53 @@
 package swim
 
 import (
+	"container/heap"
 	"sort"
 )
 
+// An eviction policy selects the broadcast to remove when a bounded
+// broadcast queue is full.
+type EvictionPolicy int
+
+const (
+	// Evict the broadcast with the lowest priority, then the highest class,
+	// then the oldest.
+	EvictLowestPriority EvictionPolicy = iota
+
+	// Evict the broadcast transmitted the most times, then as for
+	// EvictLowestPriority.
+	EvictMostTransmitted
+)
+
 // A broadcast queue implements a priority queue ordered on the number of
-// transmission attempts and the priority class of the broadcasts.
+// transmission attempts and the priority class of the broadcasts. The queue
+// is an indexed binary heap, so that pushing, invalidating, removing, and
+// reprioritizing a broadcast take O(log n) time.
+//
+// The queue may be bounded by MaxLen. When a full queue receives a new
+// broadcast, a queued broadcast is evicted according to the Policy. State
+// broadcasts are protected from user broadcasts: a user broadcast may only
+// evict another user broadcast and is otherwise dropped.
 type BroadcastQueue struct {
-	live   map[BroadcastTag]*Broadcast // Broadcasts by tag for invalidation
-	sorted byPriority                  // Broadcasts queue in list form
-	order  int
+	MaxLen  int            // Maximum number of queued broadcasts, or 0 if unbounded
+	Policy  EvictionPolicy // Eviction policy, which must not change after use
+	Dropped uint64         // Number of new broadcasts dropped when full
+	Evicted uint64         // Number of queued broadcasts evicted when full
+
+	live  map[BroadcastTag]*Broadcast // Broadcasts by tag for invalidation
+	heap  byPriority                  // Broadcasts in heap order
+	users evictionHeap                // User broadcasts in eviction order
+	state evictionHeap                // State broadcasts in eviction order
+	order int
 }
 
 func NewBroadcastQueue() *BroadcastQueue {
-	return &BroadcastQueue{
+	q := &BroadcastQueue{
 		live: make(map[BroadcastTag]*Broadcast),
 	}
+	q.users.q = q
+	q.state.q = q
+	return q
 }
 
 // Push a broadcast onto the queue.
@@ -25,59 +57,200 @@ func (q *BroadcastQueue) Push(bcast *Broadcast) {
 	bcast.order = q.order
 	q.order += 1
 
-	// invalidate an existing broadcast or add it to the queue
+	// invalidate an existing broadcast
 	tag := bcast.Event.Tag()
 	if that, ok := q.live[tag]; ok {
 		if bcast.Invalidates(that) {
 
 			// signal we're done
-			if that.Done != nil {
-				that.Done <- struct{}{}
-			}
+			that.finish(BroadcastSuperseded)
 
-			// replace
+			// replace in place
+			i := that.index
+			that.index = -1
+			bcast.index = i
+			q.heap[i] = bcast
 			q.live[tag] = bcast
+			heap.Fix(&q.heap, i)
+
+			h := q.evictionHeap(bcast)
+			i = that.evict
+			that.evict = -1
+			bcast.evict = i
+			h.items[i] = bcast
+			heap.Fix(h, i)
+
+		} else {
+
+			// the existing broadcast is as new, so this one is not queued
+			bcast.finish(BroadcastSuperseded)
+
 		}
-	} else {
-		q.live[tag] = bcast
+		return
 	}
 
-	// not sorted
-	q.sorted = nil
+	// make room for the broadcast
+	if q.MaxLen > 0 && len(q.heap) >= q.MaxLen {
+		victim := q.victim(bcast)
+		if victim == bcast {
+			q.Dropped += 1
+			// signal we're done
+			bcast.finish(BroadcastEvicted)
+			return
+		}
+		q.Evicted += 1
+		q.Remove(victim, BroadcastEvicted)
+	}
+
+	q.live[tag] = bcast
+	heap.Push(&q.heap, bcast)
+	heap.Push(q.evictionHeap(bcast), bcast)
 }
 
-// Remove the broadcasts for which the predicate returns true.
-func (q *BroadcastQueue) Prune(predicate func(b *Broadcast) bool) {
-	for tag, bcast := range q.live {
-		if predicate(bcast) {
-			delete(q.live, tag)
-			// signal we're done
-			if bcast.Done != nil {
-				bcast.Done <- struct{}{}
+// Select the broadcast to evict to make room for the given broadcast, which
+// may be the given broadcast itself.
+func (q *BroadcastQueue) victim(bcast *Broadcast) *Broadcast {
+	isState := bcast.Event.Tag().IsState
+
+	// evict user broadcasts first
+	if len(q.users.items) > 0 {
+		if that := q.users.items[0]; isState || q.users.evicts(that, bcast) {
+			return that
+		}
+	}
+
+	// only state broadcasts may evict state broadcasts
+	if isState && len(q.state.items) > 0 {
+		if that := q.state.items[0]; q.state.evicts(that, bcast) {
+			return that
+		}
+	}
+
+	return bcast
+}
+
+// Get up to n broadcasts in priority order without removing them from the
+// queue. Finding the broadcasts takes O(n log n) time regardless of the
+// length of the queue.
+func (q *BroadcastQueue) Top(n int) []*Broadcast {
+	if n > len(q.heap) {
+		n = len(q.heap)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	// best-first search of the heap
+	top := make([]*Broadcast, 0, n)
+	frontier := &heapFrontier{q: q.heap, indices: []int{0}}
+	for len(top) < n {
+		i := heap.Pop(frontier).(int)
+		top = append(top, q.heap[i])
+		for _, j := range []int{2*i + 1, 2*i + 2} {
+			if j < len(q.heap) {
+				heap.Push(frontier, j)
 			}
 		}
 	}
-	q.sorted = nil
+	return top
 }
 
-// Get the queue as a list ordered by priority. If any broadcasts in the
-// list are modified, the caller is responsible for calling q.Init().
-func (q *BroadcastQueue) List() []*Broadcast {
-	if q.sorted == nil {
-		for _, bcast := range q.live {
-			q.sorted = append(q.sorted, bcast)
+// Restore the ordering of the queue after the priority of the broadcast,
+// usually the number of transmission attempts, has changed.
+func (q *BroadcastQueue) Fix(bcast *Broadcast) {
+	if q.contains(bcast) {
+		heap.Fix(&q.heap, bcast.index)
+		heap.Fix(q.evictionHeap(bcast), bcast.evict)
+	}
+}
+
+// Remove the broadcast from the queue, signaling the given reason.
+func (q *BroadcastQueue) Remove(bcast *Broadcast, reason BroadcastReason) {
+	if !q.contains(bcast) {
+		return
+	}
+
+	heap.Remove(&q.heap, bcast.index)
+	heap.Remove(q.evictionHeap(bcast), bcast.evict)
+	delete(q.live, bcast.Event.Tag())
+
+	// signal we're done
+	bcast.finish(reason)
+}
+
+// Remove the broadcasts for which the predicate returns true, signaling the
+// given reason.
+func (q *BroadcastQueue) Prune(predicate func(b *Broadcast) bool, reason BroadcastReason) {
+	kept := q.heap[:0]
+	q.users.items = q.users.items[:0]
+	q.state.items = q.state.items[:0]
+	for _, bcast := range q.heap {
+		if predicate(bcast) {
+			delete(q.live, bcast.Event.Tag())
+			bcast.index = -1
+			bcast.evict = -1
+			// signal we're done
+			bcast.finish(reason)
+		} else {
+			bcast.index = len(kept)
+			kept = append(kept, bcast)
+			h := q.evictionHeap(bcast)
+			bcast.evict = len(h.items)
+			h.items = append(h.items, bcast)
 		}
-		sort.Sort(q.sorted)
 	}
-	return q.sorted
+
+	// clear references to the removed broadcasts
+	for i := len(kept); i < len(q.heap); i += 1 {
+		q.heap[i] = nil
+	}
+
+	q.heap = kept
+	heap.Init(&q.heap)
+	heap.Init(&q.users)
+	heap.Init(&q.state)
+}
+
+// Signal the given reason to the broadcasts waiting on the queue, leaving
+// the broadcasts in the queue without done channels.
+func (q *BroadcastQueue) Release(reason BroadcastReason) {
+	for _, bcast := range q.heap {
+		bcast.finish(reason)
+		bcast.Done = nil
+	}
+}
+
+// Get the queue as a list ordered by priority. The list is a sorted copy of
+// the queue, taking O(n log n) time to build.
+func (q *BroadcastQueue) List() []*Broadcast {
+	list := make(byPriority, len(q.heap))
+	copy(list, q.heap)
+	// sort.Slice doesn't call Swap, which would update the heap indices
+	sort.Slice(list, list.Less)
+	return list
 }
 
 // Get the number of queued broadcasts.
 func (q *BroadcastQueue) Len() int {
-	return len(q.live)
+	return len(q.heap)
 }
 
-// Private type for sorting.
+// Determine if the broadcast is in this queue.
+func (q *BroadcastQueue) contains(bcast *Broadcast) bool {
+	i := bcast.index
+	return i >= 0 && i < len(q.heap) && q.heap[i] == bcast
+}
+
+// Get the eviction heap for the broadcast.
+func (q *BroadcastQueue) evictionHeap(bcast *Broadcast) *evictionHeap {
+	if bcast.Event.Tag().IsState {
+		return &q.state
+	}
+	return &q.users
+}
+
+// Private type for the heap. Swap, Push, and Pop maintain the heap indices
+// of the broadcasts.
 type byPriority []*Broadcast
 
 // Get the number of queued broadcasts.
@@ -98,4 +271,104 @@ func (q byPriority) Less(i, j int) bool {
 // Swap the broadcast at index i with the broadcast at index j.
 func (q byPriority) Swap(i, j int) {
 	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+// Add a broadcast to the end of the heap.
+func (q *byPriority) Push(x interface{}) {
+	bcast := x.(*Broadcast)
+	bcast.index = len(*q)
+	*q = append(*q, bcast)
+}
+
+// Remove the broadcast at the end of the heap.
+func (q *byPriority) Pop() interface{} {
+	old := *q
+	n := len(old) - 1
+	bcast := old[n]
+	old[n] = nil
+	bcast.index = -1
+	*q = old[:n]
+	return bcast
+}
+
+// Private type for the eviction heaps, with the next broadcast to evict at
+// the top. Swap, Push, and Pop maintain the eviction indices of the
+// broadcasts.
+type evictionHeap struct {
+	q     *BroadcastQueue
+	items []*Broadcast
+}
+
+// Determine if broadcast a should be evicted before broadcast b.
+func (h *evictionHeap) evicts(a, b *Broadcast) bool {
+	if h.q.Policy == EvictMostTransmitted && a.Attempts != b.Attempts {
+		return a.Attempts > b.Attempts
+	}
+	if pa, pb := a.Priority(), b.Priority(); pa != pb {
+		return pa > pb
+	}
+	if a.Class != b.Class {
+		return a.Class > b.Class
+	}
+	return a.order < b.order
+}
+
+func (h *evictionHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *evictionHeap) Less(i, j int) bool {
+	return h.evicts(h.items[i], h.items[j])
+}
+
+func (h *evictionHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].evict = i
+	h.items[j].evict = j
+}
+
+func (h *evictionHeap) Push(x interface{}) {
+	bcast := x.(*Broadcast)
+	bcast.evict = len(h.items)
+	h.items = append(h.items, bcast)
+}
+
+func (h *evictionHeap) Pop() interface{} {
+	n := len(h.items) - 1
+	bcast := h.items[n]
+	h.items[n] = nil
+	bcast.evict = -1
+	h.items = h.items[:n]
+	return bcast
+}
+
+// Private type for the best-first search of the heap in Top().
+type heapFrontier struct {
+	q       byPriority
+	indices []int
+}
+
+func (f *heapFrontier) Len() int {
+	return len(f.indices)
+}
+
+func (f *heapFrontier) Less(i, j int) bool {
+	return f.q.Less(f.indices[i], f.indices[j])
+}
+
+func (f *heapFrontier) Swap(i, j int) {
+	f.indices[i], f.indices[j] = f.indices[j], f.indices[i]
+}
+
+func (f *heapFrontier) Push(x interface{}) {
+	f.indices = append(f.indices, x.(int))
+}
+
+func (f *heapFrontier) Pop() interface{} {
+	n := len(f.indices) - 1
+	i := f.indices[n]
+	f.indices = f.indices[:n]
+	return i
 }
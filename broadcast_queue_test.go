@@ -1,6 +1,7 @@
 package swim
 
 import (
+	"sort"
 	"testing"
 )
 
@@ -19,7 +20,7 @@ func TestBroadcastQueue(t *testing.T) {
 	}
 
 	// class 0 broadcast
-	done := make(chan struct{}, 1)
+	done := make(chan BroadcastResult, 1)
 	event0 := &SuspectEvent{From: 1, Id: 2, Incarnation: Seq(3)}
 	bcast0 := &Broadcast{Class: 0, Event: event0, Done: done}
 	bqueue.Push(bcast0)
@@ -29,7 +30,7 @@ func TestBroadcastQueue(t *testing.T) {
 		t.Fatalf("Expected list of broadcast 0")
 	}
 
-	bqueue.Prune(prune(bcast0))
+	bqueue.Prune(prune(bcast0), BroadcastDelivered)
 	if l := bqueue.Len(); l != 0 {
 		t.Fatalf("Expected length of 0 got %v", l)
 	}
@@ -47,7 +48,7 @@ func TestBroadcastQueue(t *testing.T) {
 		t.Fatalf("Expected length of 1")
 	}
 
-	bqueue.Prune(prune(bcast1))
+	bqueue.Prune(prune(bcast1), BroadcastDelivered)
 	if l := bqueue.Len(); l != 0 {
 		t.Fatalf("Expected length of 0 got %v", l)
 	}
@@ -61,14 +62,14 @@ func TestBroadcastQueue(t *testing.T) {
 		t.Fatalf("Expected list of broadcast 0 and 1 got %v", bqueue.List())
 	}
 
-	bqueue.Prune(prune(bcast1))
+	bqueue.Prune(prune(bcast1), BroadcastDelivered)
 	if l := bqueue.Len(); l != 1 {
 		t.Fatalf("Expected length of 1 got %v", l)
 	} else if bqueue.List()[0] != bcast0 {
 		t.Fatalf("Expected list of broadcast 0")
 	}
 
-	bqueue.Prune(prune(bcast0))
+	bqueue.Prune(prune(bcast0), BroadcastDelivered)
 	if l := bqueue.Len(); l != 0 {
 		t.Fatalf("Expected length of 0 got %v", l)
 	}
@@ -134,8 +135,312 @@ func TestBroadcastQueue(t *testing.T) {
 	bqueue.Push(bcast2)
 	bqueue.Prune(func(b *Broadcast) bool {
 		return b == bcast0
-	})
+	}, BroadcastDelivered)
 	if l := bqueue.Len(); l != 2 {
 		t.Fatalf("Expected length of 2 got %v", l)
 	}
 }
+
+func TestBroadcastQueueHeap(t *testing.T) {
+	bqueue := NewBroadcastQueue()
+
+	// check the queue against a sorted list
+	check := func() {
+		list := bqueue.List()
+		if l := len(list); l != bqueue.Len() {
+			t.Fatalf("Expected list of length %v got %v", bqueue.Len(), l)
+		}
+		for i := 1; i < len(list); i += 1 {
+			if byPriority(list).Less(i, i-1) {
+				t.Fatalf("Expected sorted list at %v", i)
+			}
+		}
+		top := bqueue.Top(len(list) + 1)
+		for i := range list {
+			if top[i] != list[i] {
+				t.Fatalf("Expected top %v to match list", i)
+			}
+		}
+	}
+
+	bcasts := make([]*Broadcast, 100)
+	for i := range bcasts {
+		event := &SuspectEvent{From: 1, Id: uint64(i), Incarnation: Seq(1)}
+		bcasts[i] = &Broadcast{Class: uint(i%3 + 1), Event: event}
+		bqueue.Push(bcasts[i])
+	}
+	check()
+
+	// top without removing
+	if top := bqueue.Top(5); len(top) != 5 {
+		t.Fatalf("Expected 5 broadcasts got %v", len(top))
+	} else if bqueue.Len() != 100 {
+		t.Fatalf("Expected length of 100 got %v", bqueue.Len())
+	}
+
+	// reprioritize
+	for i, bcast := range bcasts {
+		bcast.Attempts = uint(i * 7 % 11)
+		bqueue.Fix(bcast)
+	}
+	check()
+
+	// invalidate in place
+	done := make(chan BroadcastResult, 1)
+	bcasts[10].Done = done
+	event := &SuspectEvent{From: 1, Id: 10, Incarnation: Seq(2)}
+	bcast := &Broadcast{Class: 1, Event: event}
+	bqueue.Push(bcast)
+	<-done
+	if bqueue.Len() != 100 {
+		t.Fatalf("Expected length of 100 got %v", bqueue.Len())
+	}
+	check()
+
+	// remove
+	bcasts[20].Done = done
+	bqueue.Remove(bcasts[20], BroadcastDelivered)
+	<-done
+	bqueue.Remove(bcasts[20], BroadcastDelivered)
+	bqueue.Remove(bcasts[10], BroadcastDelivered)
+	if bqueue.Len() != 99 {
+		t.Fatalf("Expected length of 99 got %v", bqueue.Len())
+	}
+	check()
+
+	// prune
+	bqueue.Prune(func(b *Broadcast) bool {
+		return b.Attempts > 5
+	}, BroadcastDelivered)
+	for _, b := range bqueue.List() {
+		if b.Attempts > 5 {
+			t.Fatalf("Expected %v to be pruned", b)
+		}
+	}
+	check()
+}
+
+func TestBroadcastQueueBounded(t *testing.T) {
+	bqueue := NewBroadcastQueue()
+	bqueue.MaxLen = 4
+
+	done := make(map[*Broadcast]chan BroadcastResult)
+	user := func(incarnation uint64) *Broadcast {
+		event := &UserEvent{From: 1, Incarnation: Seq(incarnation)}
+		bcast := &Broadcast{Class: 2, Event: event, Done: make(chan BroadcastResult, 1)}
+		done[bcast] = bcast.Done
+		return bcast
+	}
+	state := func(id uint64, class uint) *Broadcast {
+		event := &DeathEvent{From: 1, Id: id, Incarnation: Seq(1)}
+		bcast := &Broadcast{Class: class, Event: event, Done: make(chan BroadcastResult, 1)}
+		done[bcast] = bcast.Done
+		return bcast
+	}
+	expect := func(bcast *Broadcast, reason BroadcastReason) {
+		if result := <-done[bcast]; result.Reason != reason {
+			t.Fatalf("Expected reason %v got %v", reason, result.Reason)
+		}
+	}
+	queued := func(bcast *Broadcast) bool {
+		for _, b := range bqueue.List() {
+			if b == bcast {
+				return true
+			}
+		}
+		return false
+	}
+
+	// fill the queue
+	s0, s1 := state(0, 1), state(1, 2)
+	u0, u1 := user(10), user(11)
+	for _, bcast := range []*Broadcast{s0, s1, u0, u1} {
+		bqueue.Push(bcast)
+	}
+	if bqueue.Len() != 4 {
+		t.Fatalf("Expected length of 4 got %v", bqueue.Len())
+	}
+
+	// state broadcasts evict user broadcasts first, oldest first
+	s2 := state(2, 1)
+	bqueue.Push(s2)
+	expect(u0, BroadcastEvicted)
+	if bqueue.Len() != 4 || queued(u0) || !queued(s2) {
+		t.Fatalf("Expected user broadcast 0 to be evicted")
+	} else if bqueue.Evicted != 1 || bqueue.Dropped != 0 {
+		t.Fatalf("Expected 1 evicted got %v, %v", bqueue.Evicted, bqueue.Dropped)
+	}
+
+	// user broadcasts evict user broadcasts
+	u1.Attempts = 3
+	bqueue.Fix(u1)
+	u2 := user(12)
+	bqueue.Push(u2)
+	expect(u1, BroadcastEvicted)
+	if queued(u1) || !queued(u2) {
+		t.Fatalf("Expected user broadcast 1 to be evicted")
+	} else if bqueue.Evicted != 2 {
+		t.Fatalf("Expected 2 evicted got %v", bqueue.Evicted)
+	}
+
+	// user broadcasts never evict state broadcasts
+	bqueue.Remove(u2, BroadcastDelivered)
+	expect(u2, BroadcastDelivered)
+	s3 := state(3, 1)
+	bqueue.Push(s3)
+	u3 := user(13)
+	bqueue.Push(u3)
+	expect(u3, BroadcastEvicted)
+	if queued(u3) || bqueue.Len() != 4 {
+		t.Fatalf("Expected user broadcast 3 to be dropped")
+	} else if bqueue.Dropped != 1 {
+		t.Fatalf("Expected 1 dropped got %v", bqueue.Dropped)
+	}
+
+	// state broadcasts evict the lowest priority state broadcast
+	s1.Attempts = 2
+	bqueue.Fix(s1)
+	s4 := state(4, 2)
+	bqueue.Push(s4)
+	expect(s1, BroadcastEvicted)
+	if queued(s1) || !queued(s4) {
+		t.Fatalf("Expected state broadcast 1 to be evicted")
+	}
+
+	// new broadcasts in a lower class are dropped
+	s5 := state(5, 3)
+	bqueue.Push(s5)
+	expect(s5, BroadcastEvicted)
+	if queued(s5) || bqueue.Dropped != 2 {
+		t.Fatalf("Expected state broadcast 5 to be dropped")
+	}
+
+	// invalidation replaces in place without evicting
+	evicted := bqueue.Evicted
+	event := &DeathEvent{From: 1, Id: 4, Incarnation: Seq(2)}
+	s4p := &Broadcast{Class: 1, Event: event}
+	bqueue.Push(s4p)
+	expect(s4, BroadcastSuperseded)
+	if bqueue.Len() != 4 || !queued(s4p) || bqueue.Evicted != evicted {
+		t.Fatalf("Expected state broadcast 4 to be replaced")
+	}
+
+	// pruning keeps the eviction order
+	bqueue.Prune(func(b *Broadcast) bool {
+		return b == s2
+	}, BroadcastDelivered)
+	expect(s2, BroadcastDelivered)
+	u4 := user(14)
+	bqueue.Push(u4)
+	u5 := user(15)
+	bqueue.Push(u5)
+	expect(u4, BroadcastEvicted)
+	if bqueue.Len() != 4 || queued(u4) || !queued(u5) {
+		t.Fatalf("Expected user broadcast 4 to be evicted")
+	}
+}
+
+func TestBroadcastQueueEvictMostTransmitted(t *testing.T) {
+	bqueue := NewBroadcastQueue()
+	bqueue.MaxLen = 3
+	bqueue.Policy = EvictMostTransmitted
+
+	state := func(id uint64, class uint) *Broadcast {
+		event := &DeathEvent{From: 1, Id: id, Incarnation: Seq(1)}
+		return &Broadcast{Class: class, Event: event, Done: make(chan BroadcastResult, 1)}
+	}
+	queued := func(bcast *Broadcast) bool {
+		for _, b := range bqueue.List() {
+			if b == bcast {
+				return true
+			}
+		}
+		return false
+	}
+
+	// fill the queue
+	s0, s1, s2 := state(0, 1), state(1, 1), state(2, 2)
+	for _, bcast := range []*Broadcast{s0, s1, s2} {
+		bqueue.Push(bcast)
+	}
+
+	// evict the most transmitted broadcast, even over one with a lower
+	// priority
+	s0.Attempts = 3
+	bqueue.Fix(s0)
+	s1.Attempts = 2
+	bqueue.Fix(s1)
+	s2.Attempts = 2
+	bqueue.Fix(s2)
+	s3 := state(3, 1)
+	bqueue.Push(s3)
+	if result := <-s0.Done; result.Reason != BroadcastEvicted {
+		t.Fatalf("Expected reason %v got %v", BroadcastEvicted, result.Reason)
+	}
+	if bqueue.Len() != 3 || queued(s0) || !queued(s1) || !queued(s2) || !queued(s3) {
+		t.Fatalf("Expected state broadcast 0 to be evicted")
+	} else if bqueue.Evicted != 1 {
+		t.Fatalf("Expected 1 evicted got %v", bqueue.Evicted)
+	}
+}
+
+// Create broadcasts for the benchmarks.
+func benchmarkBroadcasts(n int) []*Broadcast {
+	bcasts := make([]*Broadcast, n)
+	for i := range bcasts {
+		event := &DeathEvent{From: 1, Id: uint64(i), Incarnation: Seq(1)}
+		bcasts[i] = &Broadcast{Class: 2, Event: event}
+	}
+	return bcasts
+}
+
+// Benchmark piggybacking a few broadcasts on a message with 10k broadcasts
+// queued, as after a mass failure.
+func BenchmarkBroadcastQueue10k(b *testing.B) {
+	bqueue := NewBroadcastQueue()
+	for _, bcast := range benchmarkBroadcasts(10000) {
+		bqueue.Push(bcast)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		for _, bcast := range bqueue.Top(8) {
+			bcast.Attempts += 1
+			bqueue.Fix(bcast)
+		}
+	}
+}
+
+// Benchmark the same with a queue that is rebuilt and sorted after each
+// message, for comparison.
+func BenchmarkBroadcastQueueSort10k(b *testing.B) {
+	live := make(map[BroadcastTag]*Broadcast)
+	for _, bcast := range benchmarkBroadcasts(10000) {
+		live[bcast.Event.Tag()] = bcast
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		sorted := byPriority(nil)
+		for _, bcast := range live {
+			sorted = append(sorted, bcast)
+		}
+		sort.Slice(sorted, sorted.Less)
+		for _, bcast := range sorted[:8] {
+			bcast.Attempts += 1
+		}
+	}
+}
+
+// Benchmark pushing 10k broadcasts.
+func BenchmarkBroadcastQueuePush10k(b *testing.B) {
+	bcasts := benchmarkBroadcasts(10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		bqueue := NewBroadcastQueue()
+		for _, bcast := range bcasts {
+			bqueue.Push(bcast)
+		}
+	}
+}
@@ -3,19 +3,38 @@ package swim
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Broker handles piggybacked broadcast messages, transport, and encoding.
 // The methods on this object are safe to call from multiple goroutines.
+//
+// By default, the number of broadcasts to piggyback is estimated from the
+// sizes of previous messages. When packing and the codec implements
+// SizingCodec, broadcasts are instead added in priority order until the
+// next broadcast would exceed the maximum message length.
+//
+// Broadcasts queued with a retransmit multiplier override are limited by
+// LimitFunc instead of the broadcast limit. Expired broadcasts are removed
+// instead of sent as they reach the front of the queue.
 type Broker struct {
 	Transport                  // The transport implementation to use
 	Codec      Codec           // The codec implementation to use
 	Broadcasts *BroadcastQueue // Broadcast queue
+	Packing    bool            // Pack broadcasts up to the maximum message length
+	LimitFunc  func(uint) uint // Transmission limit for a retransmit multiplier
 	l          sync.Mutex      // Broadcast lock.
 	bEstimate  float64         // Estimate of the number of broadcasts to send
 	limit      uint32          // The broadcast transmission limit
+	pruned     uint            // The limit when the queue was last pruned
+	stopped    bool            // Whether the broker was stopped
+	expiry     time.Time       // Earliest expiry of the queued broadcasts
 }
 
+// The number of times to measure a message while packing it, bounding the
+// encodes per message whatever the number of broadcasts packed.
+const kMaxPackMeasures = 3
+
 // Create a new broker.
 func NewBroker(transport Transport, codec Codec) *Broker {
 	return &Broker{
@@ -34,6 +53,58 @@ func (b *Broker) BroadcastLimit() uint {
 	return uint(atomic.LoadUint32(&b.limit))
 }
 
+// Get the number of queued broadcasts, not counting expired broadcasts.
+func (b *Broker) Pending() int {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.pruneExpired(time.Now())
+	return b.Broadcasts.Len()
+}
+
+// Remove the expired broadcasts, scanning the queue only once the earliest
+// expiry has passed.
+func (b *Broker) pruneExpired(now time.Time) {
+	if b.expiry.IsZero() || !now.After(b.expiry) {
+		return
+	}
+	next := time.Time{}
+	b.Broadcasts.Prune(func(bcast *Broadcast) bool {
+		if bcast.Expired(now) {
+			return true
+		}
+		if !bcast.Expiry.IsZero() && (next.IsZero() || bcast.Expiry.Before(next)) {
+			next = bcast.Expiry
+		}
+		return false
+	}, BroadcastExpired)
+	b.expiry = next
+}
+
+// Estimate the number of broadcasts piggybacked per message, or 0 if the
+// number is unbounded or unknown.
+func (b *Broker) BroadcastsPerMessage() float64 {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.Transport.MaxMessageLen() <= 0 || b.bEstimate <= 0.0 {
+		return 0.0
+	}
+	return b.bEstimate
+}
+
+// Get the number of broadcasts dropped because the broadcast queue was full.
+func (b *Broker) Dropped() uint64 {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.Broadcasts.Dropped
+}
+
+// Get the number of queued broadcasts evicted to make room for new ones.
+func (b *Broker) Evicted() uint64 {
+	b.l.Lock()
+	defer b.l.Unlock()
+	return b.Broadcasts.Evicted
+}
+
 // Receive and decode a message from the network.
 func (b *Broker) Recv() (*Message, error) {
 
@@ -88,40 +159,18 @@ func (b *Broker) encodeWithBroadcasts(coded *CodedMessage) error {
 	defer b.l.Unlock()
 
 	// attach broadcasts
-	if bcasts := b.Broadcasts.List(); len(bcasts) > 0 {
-		max := len(bcasts)
-
-		// limit number of piggybacked broadcasts if supported
-		if b.Transport.MaxMessageLen() > 0 && b.bEstimate > 0.0 {
-			if i := int(b.bEstimate) - len(coded.Message.Events()); i < 1 {
-				// attach at least one event
-				max = 1
-			} else if i < max {
-				// bound to number of broadcasts
-				max = i
+	if b.Broadcasts.Len() > 0 {
+		var bcasts []*Broadcast
+		if codec, ok := b.Codec.(SizingCodec); ok && b.Packing &&
+			b.Transport.MaxMessageLen() > 0 {
+			var err error
+			if bcasts, err = b.pack(codec, coded); err != nil {
+				return err
 			}
+		} else {
+			bcasts = b.Broadcasts.Top(b.estimate(coded))
 		}
-
-		// add the events
-		for _, bcast := range bcasts[:max] {
-			// lazy initialize state
-			if bcast.State == nil {
-				bcast.State = make(map[uint64]struct{})
-				bcast.State[bcast.Event.Source()] = struct{}{}
-			}
-			// don't send more broadcast to source or the same node
-			if _, ok := bcast.State[coded.Message.To]; !ok {
-				coded.Message.AddEvent(bcast.Event)
-				bcast.Attempts += 1
-				bcast.State[coded.Message.To] = struct{}{}
-			}
-		}
-
-		// prune the queue and re-sort
-		limit := b.BroadcastLimit()
-		b.Broadcasts.Prune(func(bcast *Broadcast) bool {
-			return bcast.Attempts >= limit
-		})
+		b.attach(coded, bcasts)
 	}
 
 	// encode the message
@@ -153,6 +202,260 @@ func (b *Broker) encodeWithBroadcasts(coded *CodedMessage) error {
 	return nil
 }
 
+// Estimate the number of broadcasts to attach to the message.
+func (b *Broker) estimate(coded *CodedMessage) int {
+	max := b.Broadcasts.Len()
+
+	// limit number of piggybacked broadcasts if supported
+	if b.Transport.MaxMessageLen() > 0 && b.bEstimate > 0.0 {
+		if i := int(b.bEstimate) - len(coded.Message.Events()); i < 1 {
+			// attach at least one event
+			max = 1
+		} else if i < max {
+			// bound to number of broadcasts
+			max = i
+		}
+	}
+
+	return max
+}
+
+// Find the broadcasts, in priority order, that fit in the message without
+// exceeding the maximum message length. The broadcasts already sent to the
+// recipient are included, since they are skipped when attaching.
+//
+// The sizer estimates the size of the message as broadcasts are added. The
+// message is encoded to measure its size only when the estimate exceeds the
+// maximum message length, at most kMaxPackMeasures times, and once more at
+// the end to verify the broadcasts added on the estimate alone.
+func (b *Broker) pack(codec SizingCodec, coded *CodedMessage) ([]*Broadcast, error) {
+	sizer, err := codec.NewSizer(&coded.Message)
+	if err != nil {
+		return nil, err
+	}
+	maxLen := b.Transport.MaxMessageLen()
+
+	// consider the broadcasts in ever larger batches
+	now := time.Now()
+	packed := []*Broadcast(nil)
+	events := []interface{}(nil) // Events of the broadcasts to send
+	index := []int(nil)          // Index of the broadcast of each event
+	measures := 0                // Number of times the message was measured
+	verified := 0                // Number of events known to fit
+PACK:
+	for n := 16; ; n *= 2 {
+		top := b.Broadcasts.Top(n)
+		for _, bcast := range top[len(packed):] {
+			if !b.sent(bcast, coded.Message.To) && !bcast.Expired(now) {
+				size, err := sizer.Add(bcast.Event)
+				if err != nil {
+					return nil, err
+				} else if size > maxLen {
+					// the estimate may be loose, so measure the message
+					if measures >= kMaxPackMeasures {
+						break PACK
+					}
+					measures += 1
+					size, err = b.measure(codec, coded, append(events, bcast.Event))
+					if err != nil {
+						return nil, err
+					} else if size > maxLen {
+						break PACK
+					}
+					sizer.Measured(size)
+					verified = len(events) + 1
+				}
+				events = append(events, bcast.Event)
+				index = append(index, len(packed))
+			}
+			packed = append(packed, bcast)
+		}
+		if len(top) < n {
+			break
+		}
+	}
+
+	// verify the broadcasts added on the estimate alone, dropping the last
+	// ones until the message fits
+	for len(events) > verified {
+		size, err := b.measure(codec, coded, events)
+		if err != nil {
+			return nil, err
+		} else if size <= maxLen {
+			break
+		}
+		i := len(events) - 1
+		packed = packed[:index[i]]
+		events = events[:i]
+	}
+
+	return packed, nil
+}
+
+// Split the events into batches that each fit in a copy of the message
+// within the maximum message length, as sized by the codec. If the codec
+// can't size messages or the length is unlimited, the batches have at most
+// n events instead. An event
+// too large for any message is put in a batch of its own.
+func (b *Broker) Batches(msg *Message, events []interface{}, n int) ([][]interface{}, error) {
+	codec, ok := b.Codec.(SizingCodec)
+	maxLen := b.Transport.MaxMessageLen()
+
+	batches := [][]interface{}(nil)
+	coded := &CodedMessage{Message: *msg}
+	for len(events) > 0 {
+		m := n
+		if ok && maxLen > 0 {
+			var err error
+			if m, err = b.fit(codec, coded, events, maxLen); err != nil {
+				return nil, err
+			}
+		}
+		if m > len(events) {
+			m = len(events)
+		}
+		batches = append(batches, events[:m])
+		events = events[m:]
+	}
+
+	return batches, nil
+}
+
+// Count the leading events that fit in the message, or one if the first
+// event does not fit. As for pack, the message is measured only when the
+// estimate exceeds the maximum message length, at most kMaxPackMeasures
+// times, and once more to verify the events added on the estimate alone.
+func (b *Broker) fit(codec SizingCodec, coded *CodedMessage, events []interface{}, maxLen int) (int, error) {
+	sizer, err := codec.NewSizer(&coded.Message)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	measures := 0 // Number of times the message was measured
+	verified := 0 // Number of events known to fit
+	for ; n < len(events); n += 1 {
+		size, err := sizer.Add(events[n])
+		if err != nil {
+			return 0, err
+		} else if size > maxLen {
+			if measures >= kMaxPackMeasures {
+				break
+			}
+			measures += 1
+			if size, err = b.measure(codec, coded, events[:n+1]); err != nil {
+				return 0, err
+			} else if size > maxLen {
+				break
+			}
+			sizer.Measured(size)
+			verified = n + 1
+		}
+	}
+
+	// verify the events added on the estimate alone, dropping the last ones
+	// until the message fits
+	for n > verified && n > 1 {
+		size, err := b.measure(codec, coded, events[:n])
+		if err != nil {
+			return 0, err
+		} else if size <= maxLen {
+			break
+		}
+		n -= 1
+	}
+
+	if n == 0 {
+		n = 1
+	}
+	return n, nil
+}
+
+// Encode a copy of the message with the events to measure its size.
+func (b *Broker) measure(codec Codec, coded *CodedMessage, events []interface{}) (int, error) {
+	msg := coded.Message
+	msg.EventList = make([]interface{}, 0, len(coded.Message.EventList)+len(events))
+	msg.EventList = append(msg.EventList, coded.Message.EventList...)
+	msg.AddEvent(events...)
+	m := CodedMessage{Message: msg}
+	if err := codec.Encode(&m); err != nil {
+		return 0, err
+	}
+	return m.Size, nil
+}
+
+// Attach the broadcasts to the message, updating the number of attempts.
+func (b *Broker) attach(coded *CodedMessage, bcasts []*Broadcast) {
+	limit := b.BroadcastLimit()
+	now := time.Now()
+
+	for _, bcast := range bcasts {
+		// remove expired broadcasts without sending
+		if bcast.Expired(now) {
+			b.Broadcasts.Remove(bcast, BroadcastExpired)
+			continue
+		}
+		// don't send more broadcast to source or the same node
+		if !b.sent(bcast, coded.Message.To) {
+			coded.Message.AddEvent(bcast.Event)
+			bcast.Attempts += 1
+			bcast.State[coded.Message.To] = struct{}{}
+		}
+		// remove or reprioritize the broadcast
+		if bcast.Attempts >= b.limitOf(bcast, limit) {
+			b.Broadcasts.Remove(bcast, BroadcastDelivered)
+		} else {
+			b.Broadcasts.Fix(bcast)
+		}
+	}
+
+	// only broadcasts that were just sent can reach an unchanged limit,
+	// so prune the whole queue only after the limit is lowered
+	if limit < b.pruned || limit == 0 {
+		b.Broadcasts.Prune(func(bcast *Broadcast) bool {
+			return bcast.Attempts >= b.limitOf(bcast, limit)
+		}, BroadcastDelivered)
+	}
+	b.pruned = limit
+}
+
+// Get the transmission limit for the broadcast given the broadcast limit.
+func (b *Broker) limitOf(bcast *Broadcast, limit uint) uint {
+	if bcast.Mult > 0 && b.LimitFunc != nil {
+		return b.LimitFunc(bcast.Mult)
+	}
+	return limit
+}
+
+// Determine if the broadcast was sent to or originated from the node.
+func (b *Broker) sent(bcast *Broadcast, id uint64) bool {
+	// lazy initialize state
+	if bcast.State == nil {
+		bcast.State = make(map[uint64]struct{})
+		bcast.State[bcast.Event.Source()] = struct{}{}
+	}
+	_, ok := bcast.State[id]
+	return ok
+}
+
+// Resume the broker after it was stopped.
+func (b *Broker) Start() {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.stopped = false
+}
+
+// Release the callers waiting on synchronous broadcasts with the stopped
+// reason. The broadcasts remain queued and are sent when the broker is
+// started again; until then, synchronous broadcasts are released as soon as
+// they are queued.
+func (b *Broker) Stop() {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.stopped = true
+	b.Broadcasts.Release(BroadcastStopped)
+}
+
 // Queue a broadcast event.
 func (b *Broker) Broadcast(event BroadcastEvent) {
 	b.broadcastWithPriority(event, 2)
@@ -163,6 +466,32 @@ func (b *Broker) BroadcastL(event BroadcastEvent) {
 	b.broadcastWithPriority(event, 3)
 }
 
+// Queue a broadcast event with the given options. Classes below 2 are
+// reserved for membership broadcasts and are raised to 2.
+func (b *Broker) BroadcastWithOptions(event BroadcastEvent, opts BroadcastOptions) {
+	class := opts.Class
+	if class < 2 {
+		class = 2
+	}
+
+	// lock for concurrent access
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	// track the earliest expiry for pruning
+	if !opts.Expiry.IsZero() && (b.expiry.IsZero() || opts.Expiry.Before(b.expiry)) {
+		b.expiry = opts.Expiry
+	}
+
+	// add broadcast to queue
+	b.Broadcasts.Push(&Broadcast{
+		Class:  class,
+		Event:  event,
+		Mult:   opts.RetransmitMult,
+		Expiry: opts.Expiry,
+	})
+}
+
 func (b *Broker) broadcastWithPriority(event BroadcastEvent, prio uint) {
 
 	// lock for concurrent access
@@ -173,18 +502,26 @@ func (b *Broker) broadcastWithPriority(event BroadcastEvent, prio uint) {
 	b.Broadcasts.Push(&Broadcast{Class: prio, Event: event})
 }
 
-// Broadcast an event and notify on the done channel when the broadcast is
-// removed from the queue, either from invalidation or after reaching the
-// broadcast transmission limit.
-func (b *Broker) BroadcastSync(event BroadcastEvent) chan struct{} {
-	done := make(chan struct{}, 1)
+// Broadcast an event and send the result on the done channel when the
+// broadcast is removed from the queue, either from invalidation, eviction, or
+// after reaching the broadcast transmission limit, or when the broker is
+// stopped. If the broker is stopped, the result is sent immediately.
+func (b *Broker) BroadcastSync(event BroadcastEvent) chan BroadcastResult {
+	done := make(chan BroadcastResult, 1)
 
 	// lock for concurrent access
 	b.l.Lock()
 	defer b.l.Unlock()
 
 	// add broadcast to queue with high priority
-	b.Broadcasts.Push(&Broadcast{Class: 1, Event: event, Done: done})
+	bcast := &Broadcast{Class: 1, Event: event, Done: done}
+	b.Broadcasts.Push(bcast)
+
+	// don't wait on a stopped broker
+	if b.stopped && b.Broadcasts.contains(bcast) {
+		bcast.finish(BroadcastStopped)
+		bcast.Done = nil
+	}
 
 	// return async channel
 	return done
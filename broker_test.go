@@ -3,6 +3,7 @@ package swim
 import (
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -82,7 +83,7 @@ func TestBroker(t *testing.T) {
 	}
 
 	// test broadcast
-	suspectEvent := SuspectEvent{13, 19, Seq(8)}
+	suspectEvent := SuspectEvent{13, 19, Seq(8), nil}
 	broker.SetBroadcastLimit(1)
 	broker.Broadcast(&suspectEvent)
 
@@ -119,7 +120,251 @@ func TestBroker(t *testing.T) {
 	<-transport.to
 	<-transport.outbox
 
-	<-done
+	if result := <-done; result.Reason != BroadcastDelivered {
+		t.Fatalf("Expected delivered got %v", result.Reason)
+	} else if result.Nodes != 1 {
+		t.Fatalf("Expected 1 node got %v", result.Nodes)
+	}
+}
+
+func TestBrokerStop(t *testing.T) {
+	broker := NewBroker(newTestTransport(0), new(GobCodec))
+
+	// release waiting broadcasts on stop
+	done := broker.BroadcastSync(&UserEvent{From: 1, Incarnation: Seq(1)})
+	broker.Stop()
+	if len(done) == 0 {
+		t.Fatalf("Expected broadcast to be released")
+	} else if result := <-done; result.Reason != BroadcastStopped {
+		t.Fatalf("Expected stopped got %v", result.Reason)
+	}
+
+	// release new broadcasts immediately, but keep them queued
+	done = broker.BroadcastSync(&UserEvent{From: 1, Incarnation: Seq(2)})
+	if len(done) == 0 {
+		t.Fatalf("Expected broadcast to be released")
+	} else if result := <-done; result.Reason != BroadcastStopped {
+		t.Fatalf("Expected stopped got %v", result.Reason)
+	} else if broker.Broadcasts.Len() != 2 {
+		t.Fatalf("Expected 2 broadcasts got %v", broker.Broadcasts.Len())
+	}
+
+	// wait again once started
+	broker.Start()
+	if done := broker.BroadcastSync(&UserEvent{From: 1, Incarnation: Seq(3)}); len(done) != 0 {
+		t.Fatalf("Expected broadcast to wait")
+	}
+}
+
+func TestBrokerBroadcastSyncSuperseded(t *testing.T) {
+	broker := NewBroker(newTestTransport(0), new(GobCodec))
+	broker.Broadcast(&SuspectEvent{From: 1, Id: 2, Incarnation: Seq(2)})
+
+	// an older broadcast for the same node is not queued, but released
+	done := broker.BroadcastSync(&AliveEvent{From: 1, Node: Node{Id: 2, Incarnation: Seq(1)}})
+	select {
+	case result := <-done:
+		if result.Reason != BroadcastSuperseded {
+			t.Fatalf("Expected superseded got %v", result.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected broadcast to be released")
+	}
+	if n := broker.Broadcasts.Len(); n != 1 {
+		t.Fatalf("Expected 1 broadcast got %v", n)
+	}
+}
+
+func TestBrokerBatches(t *testing.T) {
+	codec := new(GobCodec)
+	broker := NewBroker(newTestTransport(512), codec)
+	msg := &Message{From: 1, To: 2}
+
+	// nodes with large user data
+	events := []interface{}{}
+	for i := 0; i < 20; i += 1 {
+		data := strings.Repeat("x", 20*i)
+		events = append(events, &AliveEvent{From: 1, Node: Node{Id: uint64(i + 10), UserData: data}})
+	}
+	events = append(events, &AliveEvent{From: 1, Node: Node{Id: 99, UserData: strings.Repeat("y", 1024)}})
+
+	batches, err := broker.Batches(msg, events, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each batch fits, except the event too large on its own, and the
+	// batches keep the events in order
+	i := 0
+	for _, batch := range batches {
+		size, err := broker.measure(codec, &CodedMessage{Message: *msg}, batch)
+		if err != nil {
+			t.Fatal(err)
+		} else if size > 512 && len(batch) > 1 {
+			t.Fatalf("Expected batch of %v events to fit got %v bytes", len(batch), size)
+		}
+		for _, event := range batch {
+			if event != events[i] {
+				t.Fatalf("Expected event %v got %v", i, event)
+			}
+			i += 1
+		}
+	}
+	if i != len(events) {
+		t.Fatalf("Expected %v events got %v", len(events), i)
+	} else if last := batches[len(batches)-1]; len(last) != 1 {
+		t.Fatalf("Expected the oversized event alone got %v events", len(last))
+	} else if len(batches) < 3 {
+		t.Fatalf("Expected several batches got %v", len(batches))
+	}
+
+	// without a limit, the events are batched by count
+	broker = NewBroker(newTestTransport(0), codec)
+	if batches, err := broker.Batches(msg, events, 8); err != nil {
+		t.Fatal(err)
+	} else if len(batches) != 3 || len(batches[0]) != 8 || len(batches[2]) != 5 {
+		t.Fatalf("Expected batches of 8 events got %v batches", len(batches))
+	}
+}
+
+func TestBrokerPacking(t *testing.T) {
+	mms := 512
+	codec := new(GobCodec)
+	transport := newTestTransport(mms)
+	broker := NewBroker(transport, codec)
+	broker.Packing = true
+	broker.SetBroadcastLimit(10)
+
+	for i := 0; i < 50; i += 1 {
+		broker.Broadcast(&DeathEvent{From: 1, Id: uint64(i + 100), Incarnation: Seq(i)})
+	}
+
+	node := &Node{Id: 2, Addrs: []string{"2"}}
+	msg := new(Message)
+	msg.To = node.Id
+	msg.AddEvent(&AckEvent{From: 3, Time: time.Unix(0, 9)})
+
+	for i := 0; i < 3; i += 1 {
+		next := broker.Broadcasts.List()
+		broker.SendTo(node.Addrs, msg)
+		<-transport.to
+		out := <-transport.outbox
+
+		n := len(out.Message.Events()) - 1
+		if out.Size > mms {
+			t.Fatalf("Expected message of at most %v bytes, got %v", mms, out.Size)
+		} else if n < 2 {
+			t.Fatalf("Expected broadcasts to be packed, got %v", n)
+		}
+
+		// the next broadcast should not have fit
+		over := &CodedMessage{Message: out.Message}
+		over.Message.EventList = append([]interface{}(nil), out.Message.EventList...)
+		over.Message.AddEvent(next[n].Event)
+		if err := codec.Encode(over); err != nil {
+			t.Fatal(err)
+		} else if over.Size <= mms {
+			t.Fatalf("Expected message to be full, %v bytes with another", over.Size)
+		}
+
+		// don't send the same broadcasts to the same node
+		msg.To += 1
+	}
+
+	// the message itself must not be modified
+	if len(msg.Events()) != 1 {
+		t.Fatalf("Expected message to be unmodified")
+	}
+}
+
+func TestBrokerPackingEncodes(t *testing.T) {
+	mms := 1400
+	codec := &countingCodec{GobCodec: new(GobCodec)}
+	transport := newTestTransport(mms)
+	broker := NewBroker(transport, codec)
+	broker.Packing = true
+	broker.SetBroadcastLimit(10)
+
+	for i := 0; i < 1000; i += 1 {
+		broker.Broadcast(&DeathEvent{From: 1, Id: uint64(i + 100), Incarnation: Seq(i)})
+	}
+
+	msg := new(Message)
+	msg.AddEvent(&AckEvent{From: 3, Time: time.Unix(0, 9)})
+	for i := 0; i < 3; i += 1 {
+		codec.encodes = 0
+		msg.To = uint64(i + 2)
+		broker.SendTo([]string{"2"}, msg)
+		<-transport.to
+		out := <-transport.outbox
+
+		// the message is encoded a bounded number of times however many
+		// broadcasts are packed
+		if n := len(out.Message.Events()) - 1; n < 20 {
+			t.Fatalf("Expected broadcasts to be packed, got %v", n)
+		} else if out.Size > mms {
+			t.Fatalf("Expected message of at most %v bytes, got %v", mms, out.Size)
+		} else if codec.encodes > kMaxPackMeasures+2 {
+			t.Fatalf("Expected at most %v encodes, got %v", kMaxPackMeasures+2, codec.encodes)
+		}
+	}
+}
+
+func TestBrokerOptions(t *testing.T) {
+	transport := newTestTransport(0)
+	broker := NewBroker(transport, new(GobCodec))
+	broker.SetBroadcastLimit(2)
+	broker.LimitFunc = func(mult uint) uint {
+		return mult
+	}
+
+	// queue broadcasts with options
+	hint := &UserEvent{From: 1, Incarnation: Seq(1)}
+	notice := &UserEvent{From: 1, Incarnation: Seq(2)}
+	stale := &UserEvent{From: 1, Incarnation: Seq(3)}
+	death := &DeathEvent{From: 1, Id: 4, Incarnation: Seq(1)}
+	broker.BroadcastWithOptions(hint, BroadcastOptions{Class: 3, RetransmitMult: 1})
+	broker.BroadcastWithOptions(notice, BroadcastOptions{Class: 1, RetransmitMult: 4})
+	broker.BroadcastWithOptions(stale, BroadcastOptions{Expiry: time.Now().Add(-time.Second)})
+	broker.Broadcast(death)
+
+	for _, bcast := range broker.Broadcasts.List() {
+		if bcast.Event == hint && bcast.Class != 3 {
+			t.Fatalf("Expected class 3 got %v", bcast.Class)
+		} else if bcast.Event == stale && bcast.Class != 2 {
+			t.Fatalf("Expected default class 2 got %v", bcast.Class)
+		} else if bcast.Event == notice && bcast.Class != 2 {
+			t.Fatalf("Expected class 1 to be raised to 2 got %v", bcast.Class)
+		}
+	}
+
+	// expired broadcasts are not pending
+	if n := broker.Pending(); n != 3 {
+		t.Fatalf("Expected 3 pending broadcasts got %v", n)
+	}
+
+	// count the transmissions of each event
+	counts := make(map[BroadcastTag]int)
+	for i := 0; i < 6; i += 1 {
+		msg := &Message{To: uint64(i + 10)}
+		broker.SendTo([]string{"node"}, msg)
+		<-transport.to
+		for _, event := range (<-transport.outbox).Message.Events() {
+			counts[event.(BroadcastEvent).Tag()] += 1
+		}
+	}
+
+	if counts[hint.Tag()] != 1 {
+		t.Fatalf("Expected hint to be sent once, got %v", counts[hint.Tag()])
+	} else if counts[notice.Tag()] != 4 {
+		t.Fatalf("Expected notice to be sent 4 times, got %v", counts[notice.Tag()])
+	} else if counts[death.Tag()] != 2 {
+		t.Fatalf("Expected death to be sent twice, got %v", counts[death.Tag()])
+	} else if counts[stale.Tag()] != 0 {
+		t.Fatalf("Expected expired broadcast not to be sent, got %v", counts[stale.Tag()])
+	} else if broker.Broadcasts.Len() != 0 {
+		t.Fatalf("Expected empty queue got %v", broker.Broadcasts.Len())
+	}
 }
 
 type mockCodec struct {
@@ -210,3 +455,14 @@ func (t *testTransport) SetWriteDeadline(d time.Time) error {
 func (t *testTransport) Close() error {
 	return nil
 }
+
+// Counts the encodes of whole messages.
+type countingCodec struct {
+	*GobCodec
+	encodes int
+}
+
+func (c *countingCodec) Encode(message *CodedMessage) error {
+	c.encodes += 1
+	return c.GobCodec.Encode(message)
+}
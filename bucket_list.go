@@ -1,20 +1,141 @@
 package swim
 
+import (
+	"math/rand"
+)
+
 // A bucket list selects nodes using round-robin over buckets of nodes. Each
 // bucket is at least twice as large as the next smaller bucket. The methods
 // are not safe to run concurrently.
+//
+// The nodes are kept in a balanced search tree ordered by their SortValue,
+// then by successors on a ring, so that nodes are inserted and removed
+// without re-sorting the others, which takes O(K log n) time. The sort values
+// of relative sorters, such as FingerSorter, depend on the other nodes, so all
+// nodes are re-sorted on each change instead; set Relative for such sorters
+// of your own. Either way, only the nodes crossing a bucket boundary
+// change buckets, and the buckets keep their positions in the current round,
+// so each node is still selected once per round of its bucket.
+//
+// Sorters whose distances change over time, such as LatencySorter, should
+// set ResortEvery to periodically re-sort the nodes.
+//
+// If Tier is set, the sorted nodes are instead placed in the bucket of their
+// tier, such as the TopologyTier of a TopologySorter, with tiers beyond the
+// last bucket placed in the last bucket.
 type BucketList struct {
-	K         uint   // Number of buckets to maintain
-	Sort      Sorter // Sorter implementation
-	LocalNode *Node
+	K           uint   // Number of buckets to maintain, which must not change after use
+	Sort        Sorter // Sorter implementation
+	LocalNode   *Node
+	Rand        *rand.Rand              // Source of randomness, or the global source if nil
+	ResortEvery uint                    // Number of selections between re-sorts, or 0 if never
+	Tier        func(*InternalNode) int // Bucket of each sorted node, if not nil
+	Relative    bool                    // Re-sort all nodes on each change, as for FingerSorter
 
-	nodes      []*InternalNode // List of nodes
-	buckets    []*ShuffleList  // List of buckets
+	root       *bucketEntry            // Tree of sorted nodes
+	entries    map[uint64]*bucketEntry // Tree entries by node ID
+	nodes      []*InternalNode         // Cached list of sorted nodes
+	buckets    []*bucket               // List of buckets
 	nextBucket int
+	selections uint
 }
 
 // Add nodes to the list.
 func (l *BucketList) Add(nodes ...*InternalNode) {
+	l.check()
+
+	// skip nodes already in the list
+	adds := make([]*InternalNode, 0, len(nodes))
+	seen := make(map[uint64]bool, len(nodes))
+	for _, node := range nodes {
+		if l.entries[node.Id] == nil && !seen[node.Id] {
+			seen[node.Id] = true
+			adds = append(adds, node)
+		}
+	}
+	if len(adds) == 0 {
+		return
+	}
+
+	// calculate the sort values of the new nodes on a copy, so that the
+	// order of the given nodes is left intact
+	l.Sort(append([]*InternalNode(nil), adds...), l.LocalNode)
+
+	for _, node := range adds {
+		l.insert(node)
+	}
+
+	if l.relative() {
+		l.resort()
+	}
+}
+
+// Remove nodes from the list.
+func (l *BucketList) Remove(removes ...*InternalNode) {
+	removed := false
+
+	for _, node := range removes {
+		e := l.entries[node.Id]
+		if e == nil {
+			continue
+		}
+
+		delete(l.entries, node.Id)
+		l.buckets[e.bucket].Remove(e.node)
+		l.root = l.root.remove(e)
+		l.nodes = nil
+		l.rebalance()
+		removed = true
+	}
+
+	if removed && l.relative() {
+		l.resort()
+	}
+}
+
+// Whether the sort values of the nodes depend on the other nodes.
+func (l *BucketList) relative() bool {
+	return l.Relative || isRelativeSorter(l.Sort)
+}
+
+// Set the next list of nodes from which to select, restarting the rounds of
+// the buckets.
+func (l *BucketList) Replace(nodes []*InternalNode) {
+	l.check()
+
+	// copy nodes to prevent modifying the underlying array
+	nodes = append([]*InternalNode(nil), nodes...)
+	l.Sort(nodes, l.LocalNode)
+
+	// rebuild the tree
+	l.root = nil
+	l.entries = make(map[uint64]*bucketEntry, len(nodes))
+	for _, node := range nodes {
+		if l.entries[node.Id] == nil {
+			e := l.newEntry(node)
+			l.entries[node.Id] = e
+			l.root = l.root.insert(e)
+		}
+	}
+	l.nodes = nil
+
+	// populate buckets
+	parts := make([][]*InternalNode, len(l.buckets))
+	starts := l.bounds(l.root.len())
+	for j, node := range l.List() {
+		e := l.entries[node.Id]
+		e.bucket = l.bucketOf(e, j, starts)
+		parts[e.bucket] = append(parts[e.bucket], node)
+	}
+	for i, part := range parts {
+		l.buckets[i].Replace(part)
+	}
+
+	l.selections = 0
+}
+
+// Check the required properties and initialize the list.
+func (l *BucketList) check() {
 	k := l.K
 
 	// check required properties
@@ -26,77 +147,136 @@ func (l *BucketList) Add(nodes ...*InternalNode) {
 		panic("Sort == nil")
 	}
 
-	// set next set of nodes
-	l.setNext(append(l.nodes, nodes...))
+	// initialize
+	if l.entries == nil {
+		l.entries = make(map[uint64]*bucketEntry)
+	}
+	for len(l.buckets) < int(k) {
+		l.buckets = append(l.buckets, newBucket(l.Rand))
+	}
 }
 
-// Remove nodes from the list.
-func (l *BucketList) Remove(removes ...*InternalNode) {
+// Create a tree entry for the node, keyed on its current sort value.
+func (l *BucketList) newEntry(node *InternalNode) *bucketEntry {
+	return &bucketEntry{
+		node:     node,
+		value:    node.SortValue,
+		ring:     uint64(int64(node.Id) - int64(l.LocalNode.Id)),
+		priority: mix64(node.Id),
+		size:     1,
+	}
+}
 
-	// make id map of nodes to remove
-	rms := make(map[uint64]bool)
-	for _, node := range removes {
-		rms[node.Id] = true
+// Insert a sorted node into the tree and its bucket.
+func (l *BucketList) insert(node *InternalNode) {
+	e := l.newEntry(node)
+	l.entries[node.Id] = e
+	l.root = l.root.insert(e)
+	l.nodes = nil
+
+	e.bucket = l.bucketOf(e, l.root.rank(e), l.bounds(l.root.len()))
+	l.buckets[e.bucket].Add(node)
+
+	l.rebalance()
+}
+
+// Move the nodes that crossed a bucket boundary after a node was inserted or
+// removed. Each boundary moves by at most one position, and each node by at
+// most one position, so only the nodes within two positions of a boundary
+// may have crossed it.
+func (l *BucketList) rebalance() {
+	if l.Tier != nil {
+		return
 	}
 
-	// make list of nodes
-	nodes := make([]*InternalNode, 0, len(l.nodes))
-	for _, node := range l.nodes {
-		if !rms[node.Id] {
-			nodes = append(nodes, node)
+	n := l.root.len()
+	starts := l.bounds(n)
+	for i := 1; i < len(l.buckets); i += 1 {
+		for j := starts[i] - 2; j <= starts[i]+1; j += 1 {
+			if j >= 0 && j < n {
+				l.move(l.root.at(j), bucketAt(j, starts))
+			}
 		}
 	}
-
-	// update for next
-	l.setNext(nodes)
 }
 
-// Set the next list of nodes from which to select.
-func (l *BucketList) Replace(nodes []*InternalNode) {
-	// copy nodes to prevent modifying the underlying array
-	l.setNext(append([]*InternalNode(nil), nodes...))
+// Move the node of the entry to the given bucket.
+func (l *BucketList) move(e *bucketEntry, i int) {
+	if e.bucket != i {
+		l.buckets[e.bucket].Remove(e.node)
+		l.buckets[i].Add(e.node)
+		e.bucket = i
+	}
 }
 
-// Set the next list of nodes from which to select, modifying the underlying
-// array.
-func (l *BucketList) setNext(nodes []*InternalNode) {
+// Re-sort the nodes, moving the nodes whose bucket changed.
+func (l *BucketList) resort() {
 
-	// number of buckets
-	k := int(l.K)
+	// sort a copy of the nodes
+	nodes := append([]*InternalNode(nil), l.List()...)
+	l.Sort(nodes, l.LocalNode)
 
-	// update number of buckets
-	buckets := l.buckets
-	n := len(buckets)
-	if n < k {
-		for ; n < k; n += 1 {
-			buckets = append(buckets, new(ShuffleList))
-		}
-	} else if n > k {
-		buckets = buckets[:k]
+	// rebuild the tree with the new sort values
+	l.root = nil
+	for _, node := range nodes {
+		e := l.entries[node.Id]
+		e.value = node.SortValue
+		e.left, e.right, e.size = nil, nil, 1
+		l.root = l.root.insert(e)
 	}
+	l.nodes = nil
 
-	// sort nodes
-	l.Sort(nodes, l.LocalNode)
+	// update buckets
+	starts := l.bounds(len(nodes))
+	for j, node := range l.List() {
+		e := l.entries[node.Id]
+		l.move(e, l.bucketOf(e, j, starts))
+	}
+}
 
-	// populate buckets
-	unallocated := nodes
+// Get the bucket of the node at the given position, by tier if set.
+func (l *BucketList) bucketOf(e *bucketEntry, j int, starts []int) int {
+	if l.Tier == nil {
+		return bucketAt(j, starts)
+	}
+
+	k := len(l.buckets)
+	i := l.Tier(e.node)
+	if i >= k {
+		i = k - 1
+	} else if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+// Get the starting positions of the buckets for n sorted nodes, followed by
+// n, with the last bucket taking the largest share of the most distant
+// nodes.
+func (l *BucketList) bounds(n int) []int {
+	k := len(l.buckets)
+	starts := make([]int, k+1)
+	starts[k] = n
+
+	unallocated := n
 	for i := k - 1; i > 0; i -= 1 {
 		q := 1 << uint(i)
 		d := (q << 1) - 1
-		l := len(unallocated)
-		n := (l*q + d - 1) / d
-		bucket := buckets[i]
-		bucket.Replace(unallocated[l-n:])
-		unallocated = unallocated[:l-n]
+		unallocated -= (unallocated*q + d - 1) / d
+		starts[i] = unallocated
 	}
 
-	// populate first bucket
-	bucket := buckets[0]
-	bucket.Replace(unallocated)
+	return starts
+}
 
-	// save changes
-	l.nodes = nodes
-	l.buckets = buckets
+// Get the bucket containing the given position.
+func bucketAt(j int, starts []int) int {
+	for i := len(starts) - 2; i > 0; i -= 1 {
+		if j >= starts[i] {
+			return i
+		}
+	}
+	return 0
 }
 
 // Select a node from the list.
@@ -107,6 +287,14 @@ func (l *BucketList) Next() *InternalNode {
 		return nil
 	}
 
+	// periodically re-sort
+	if l.ResortEvery > 0 {
+		if l.selections += 1; l.selections > l.ResortEvery {
+			l.resort()
+			l.selections = 1
+		}
+	}
+
 	// get next node
 	i := l.nextBucket % len(l.buckets)
 	for range l.buckets {
@@ -121,13 +309,285 @@ func (l *BucketList) Next() *InternalNode {
 	return nil
 }
 
-// Get a list of the contained nodes. The returned list references the
-// internal slice and should not be modified.
+// Get a list of the contained nodes in sorted order. The returned list
+// references the internal slice and should not be modified.
 func (l *BucketList) List() []*InternalNode {
+	if l.nodes == nil && l.root != nil {
+		l.nodes = make([]*InternalNode, 0, l.root.len())
+		l.root.walk(func(e *bucketEntry) {
+			l.nodes = append(l.nodes, e.node)
+		})
+	}
 	return l.nodes
 }
 
 // Get the length of the list.
 func (l *BucketList) Len() int {
-	return len(l.nodes)
+	return l.root.len()
+}
+
+// A bucket selects nodes round-robin, shuffling the nodes after each round,
+// like a ShuffleList. The position of each node is indexed, so that adding
+// and removing a node takes O(1) time without restarting the round. Added
+// nodes are selected in the current round.
+type bucket struct {
+	rand  *rand.Rand      // Source of randomness, or the global source if nil
+	nodes []*InternalNode // Nodes selected in this round, then the rest
+	index map[uint64]int  // Position of each node by ID
+	next  int             // Position of the next node in this round
+}
+
+func newBucket(r *rand.Rand) *bucket {
+	return &bucket{rand: r, index: make(map[uint64]int)}
+}
+
+// Add a node to the nodes not yet selected in this round, if not in the
+// bucket.
+func (b *bucket) Add(node *InternalNode) {
+	if _, ok := b.index[node.Id]; ok {
+		return
+	}
+	b.index[node.Id] = len(b.nodes)
+	b.nodes = append(b.nodes, node)
+}
+
+// Remove a node from the bucket.
+func (b *bucket) Remove(node *InternalNode) {
+	i, ok := b.index[node.Id]
+	if !ok {
+		return
+	}
+
+	// if we've already selected this node, replace it with the last
+	// selected node, keeping the selected nodes together
+	if i < b.next {
+		b.next -= 1
+		b.set(i, b.nodes[b.next])
+		i = b.next
+	}
+
+	// replace with the last node
+	last := len(b.nodes) - 1
+	if i < last {
+		b.set(i, b.nodes[last])
+	}
+	b.nodes[last] = nil
+	b.nodes = b.nodes[:last]
+	delete(b.index, node.Id)
+}
+
+// Select a node from the bucket.
+func (b *bucket) Next() *InternalNode {
+	if len(b.rest()) == 0 {
+		return nil
+	}
+	return b.take(0)
+}
+
+// Get the nodes not yet selected in this round, shuffling the nodes for a
+// new round if all have been selected. The returned list references the
+// internal slice and should not be modified.
+func (b *bucket) rest() []*InternalNode {
+	if b.next >= len(b.nodes) {
+		b.shuffle()
+		b.next = 0
+	}
+	return b.nodes[b.next:]
+}
+
+// Select the node at the given position among the nodes not yet selected in
+// this round, moving it to the selected nodes.
+func (b *bucket) take(i int) *InternalNode {
+	node := b.nodes[b.next+i]
+	b.set(b.next+i, b.nodes[b.next])
+	b.set(b.next, node)
+	b.next += 1
+	return node
+}
+
+// Set the nodes of the bucket, restarting the round.
+func (b *bucket) Replace(nodes []*InternalNode) {
+	b.nodes = nodes
+	b.index = make(map[uint64]int, len(nodes))
+	b.next = 0
+	b.shuffle()
+}
+
+// Shuffle the nodes.
+func (b *bucket) shuffle() {
+	shuffleNodes(b.rand, b.nodes)
+	for i, node := range b.nodes {
+		b.index[node.Id] = i
+	}
+}
+
+// Set the node at the given position.
+func (b *bucket) set(i int, node *InternalNode) {
+	b.nodes[i] = node
+	b.index[node.Id] = i
+}
+
+// Get a copy of the nodes in the bucket.
+func (b *bucket) List() []*InternalNode {
+	return append([]*InternalNode(nil), b.nodes...)
+}
+
+// Get the number of nodes in the bucket.
+func (b *bucket) Len() int {
+	return len(b.nodes)
+}
+
+// An entry in the tree of sorted nodes. The tree is a treap: a binary search
+// tree on the sort key that is also a heap on pseudo-random priorities, so
+// that it is balanced with high probability. Each entry records the size of
+// its subtree to find the entry at a position in O(log n) time.
+type bucketEntry struct {
+	node        *InternalNode
+	value       uint64       // Sort value when inserted
+	ring        uint64       // Ring distance from the local node, to break ties
+	priority    uint64       // Heap priority
+	bucket      int          // Bucket containing the node
+	left, right *bucketEntry // Subtrees
+	size        int          // Number of entries in the subtree
+}
+
+// Determine if the entry sorts before that entry.
+func (e *bucketEntry) less(that *bucketEntry) bool {
+	if e.value != that.value {
+		return e.value < that.value
+	}
+	return e.ring < that.ring
+}
+
+// Get the number of entries in the tree.
+func (t *bucketEntry) len() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+// Update the size of the tree.
+func (t *bucketEntry) update() {
+	t.size = 1 + t.left.len() + t.right.len()
+}
+
+// Insert the entry, returning the new root.
+func (t *bucketEntry) insert(e *bucketEntry) *bucketEntry {
+	if t == nil {
+		return e
+	}
+	if e.priority > t.priority {
+		e.left, e.right = t.split(e)
+		e.update()
+		return e
+	}
+	if e.less(t) {
+		t.left = t.left.insert(e)
+	} else {
+		t.right = t.right.insert(e)
+	}
+	t.update()
+	return t
+}
+
+// Remove the entry, returning the new root.
+func (t *bucketEntry) remove(e *bucketEntry) *bucketEntry {
+	if t == nil {
+		return nil
+	}
+	if t == e {
+		root := merge(e.left, e.right)
+		e.left, e.right, e.size = nil, nil, 1
+		return root
+	}
+	if e.less(t) {
+		t.left = t.left.remove(e)
+	} else {
+		t.right = t.right.remove(e)
+	}
+	t.update()
+	return t
+}
+
+// Split the tree into the entries before the given entry and the rest.
+func (t *bucketEntry) split(e *bucketEntry) (*bucketEntry, *bucketEntry) {
+	if t == nil {
+		return nil, nil
+	}
+	if t.less(e) {
+		left, right := t.right.split(e)
+		t.right = left
+		t.update()
+		return t, right
+	}
+	left, right := t.left.split(e)
+	t.left = right
+	t.update()
+	return left, t
+}
+
+// Merge two trees, where the entries of a sort before the entries of b.
+func merge(a, b *bucketEntry) *bucketEntry {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		a.right = merge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = merge(a, b.left)
+	b.update()
+	return b
+}
+
+// Get the position of the entry in the tree.
+func (t *bucketEntry) rank(e *bucketEntry) int {
+	rank := 0
+	for t != nil && t != e {
+		if e.less(t) {
+			t = t.left
+		} else {
+			rank += t.left.len() + 1
+			t = t.right
+		}
+	}
+	return rank + e.left.len()
+}
+
+// Get the entry at the given position in the tree.
+func (t *bucketEntry) at(j int) *bucketEntry {
+	for t != nil {
+		if n := t.left.len(); j < n {
+			t = t.left
+		} else if j > n {
+			j -= n + 1
+			t = t.right
+		} else {
+			break
+		}
+	}
+	return t
+}
+
+// Call the function on each entry in sorted order.
+func (t *bucketEntry) walk(f func(e *bucketEntry)) {
+	if t != nil {
+		t.left.walk(f)
+		f(t)
+		t.right.walk(f)
+	}
+}
+
+// Mix the bits of the value, to derive the priority of a node from its ID.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
 }
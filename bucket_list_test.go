@@ -1,8 +1,10 @@
 package swim
 
 import (
+	"math/rand"
 	"sort"
 	"testing"
+	"time"
 )
 
 func TestBucketList(t *testing.T) {
@@ -112,3 +114,251 @@ func TestBucketList(t *testing.T) {
 	testBucketLenths([]int{3, 6, 13})
 	testBucketLen()
 }
+
+func TestBucketListResort(t *testing.T) {
+	bl := &BucketList{
+		K:           2,
+		Sort:        LatencySorter,
+		LocalNode:   &Node{},
+		ResortEvery: 4,
+	}
+
+	nodes := []*InternalNode{}
+	for i := 1; i <= 6; i += 1 {
+		node := &InternalNode{Node: Node{Id: uint64(i)}}
+		node.RTT.Hint(time.Duration(i) * time.Millisecond)
+		nodes = append(nodes, node)
+	}
+	bl.Add(nodes...)
+
+	testBucket := func(i int, expect ...uint64) {
+		ids := []uint64{}
+		for _, node := range bl.buckets[i].List() {
+			ids = append(ids, node.Id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if len(ids) != len(expect) {
+			t.Fatalf("expected bucket %v to have %v got %v", i, expect, ids)
+		}
+		for j := range ids {
+			if ids[j] != expect[j] {
+				t.Fatalf("expected bucket %v to have %v got %v", i, expect, ids)
+			}
+		}
+	}
+
+	// nearest nodes in the first bucket
+	testBucket(0, 1, 2)
+	testBucket(1, 3, 4, 5, 6)
+
+	// latencies change without re-sorting
+	nodes[0].RTT.Hint(10 * time.Millisecond)
+	nodes[5].RTT.Hint(time.Millisecond / 2)
+	for i := 0; i < 4; i += 1 {
+		bl.Next()
+	}
+	testBucket(0, 1, 2)
+
+	// re-sort on the next selection
+	bl.Next()
+	testBucket(0, 2, 6)
+	testBucket(1, 1, 3, 4, 5)
+	testListLen(t, bl, 6)
+}
+
+func TestBucketListTiers(t *testing.T) {
+	tiers := map[uint64]int{1: 0, 2: 1, 3: 1, 4: 2, 5: 3, 6: 5}
+	bl := &BucketList{
+		K:         3,
+		Sort:      func(nodes []*InternalNode, local *Node) error { sort.Sort(byId(nodes)); return nil },
+		LocalNode: &Node{},
+		Tier:      func(node *InternalNode) int { return tiers[node.Id] },
+	}
+	for id := uint64(1); id <= 6; id += 1 {
+		bl.Add(&InternalNode{Node: Node{Id: id}})
+	}
+
+	// tiers beyond the last bucket go into the last bucket
+	expect := [][]uint64{{1}, {2, 3}, {4, 5, 6}}
+	for i, ids := range expect {
+		nodes := bl.buckets[i].List()
+		sort.Sort(byId(nodes))
+		if len(nodes) != len(ids) {
+			t.Fatalf("expected bucket %v to have %v got %v", i, ids, nodes)
+		}
+		for j, node := range nodes {
+			if node.Id != ids[j] {
+				t.Fatalf("expected bucket %v to have %v got %v", i, ids, nodes)
+			}
+		}
+	}
+	testListLen(t, bl, 6)
+}
+
+func TestBucketListIncremental(t *testing.T) {
+	localNode := &Node{Id: 1 << 40}
+	sorted := 0
+	bl := &BucketList{
+		K: 4,
+		Sort: func(nodes []*InternalNode, localNode *Node) error {
+			sorted += len(nodes)
+			return RingSorter(nodes, localNode)
+		},
+		LocalNode: localNode,
+		Rand:      rand.New(rand.NewSource(1)),
+	}
+	r := rand.New(rand.NewSource(2))
+
+	// check the buckets against a full sort of the nodes
+	members := map[uint64]*InternalNode{}
+	testBuckets := func() {
+		nodes := []*InternalNode{}
+		for _, node := range members {
+			nodes = append(nodes, node)
+		}
+		RingSorter(nodes, localNode)
+		testListLen(t, bl, len(nodes))
+
+		starts := bl.bounds(len(nodes))
+		for i, b := range bl.buckets {
+			expect := nodes[starts[i]:starts[i+1]]
+			if b.Len() != len(expect) {
+				t.Fatalf("expected bucket %v of size %v got %v", i, len(expect), b.Len())
+			}
+			for _, node := range expect {
+				if j, ok := b.index[node.Id]; !ok || b.nodes[j] != node {
+					t.Fatalf("expected node %v in bucket %v", node.Id, i)
+				}
+			}
+			if len(b.index) != b.Len() {
+				t.Fatalf("expected %v indexed nodes got %v", b.Len(), len(b.index))
+			}
+		}
+		for j, node := range bl.List() {
+			if node != nodes[j] {
+				t.Fatalf("expected node %v at %v got %v", nodes[j].Id, j, node.Id)
+			}
+		}
+	}
+
+	for i := 0; i < 500; i += 1 {
+		if len(members) > 0 && r.Intn(3) == 0 {
+			for _, node := range members {
+				bl.Remove(node)
+				delete(members, node.Id)
+				break
+			}
+		} else {
+			node := &InternalNode{Node: Node{Id: r.Uint64()}}
+			members[node.Id] = node
+			sorted = 0
+			bl.Add(node)
+
+			// only the new node is sorted
+			if sorted != 1 {
+				t.Fatalf("expected 1 sorted node got %v", sorted)
+			}
+		}
+		testBuckets()
+		bl.Next()
+	}
+}
+
+func TestBucketListFinger(t *testing.T) {
+	localNode := &Node{Id: 1 << 40}
+
+	// the fingers depend on the other nodes, so the list is re-sorted on
+	// each change, whether the sorter is known to be relative or the list
+	// is marked as such
+	for _, bl := range []*BucketList{
+		{Sort: FingerSorter},
+		{
+			Sort: func(nodes []*InternalNode, localNode *Node) error {
+				return FingerSorter(nodes, localNode)
+			},
+			Relative: true,
+		},
+	} {
+		bl.K = 3
+		bl.LocalNode = localNode
+		bl.Rand = rand.New(rand.NewSource(1))
+		r := rand.New(rand.NewSource(2))
+
+		members := map[uint64]*InternalNode{}
+		for i := 0; i < 100; i += 1 {
+			if len(members) > 0 && r.Intn(3) == 0 {
+				for _, node := range members {
+					bl.Remove(node)
+					delete(members, node.Id)
+					break
+				}
+			} else {
+				node := &InternalNode{Node: Node{Id: r.Uint64()}}
+				members[node.Id] = node
+				bl.Add(node)
+			}
+
+			nodes := []*InternalNode{}
+			for _, node := range members {
+				nodes = append(nodes, node)
+			}
+			FingerSorter(nodes, localNode)
+			testListLen(t, bl, len(nodes))
+			for j, node := range bl.List() {
+				if node != nodes[j] {
+					t.Fatalf("expected node %v at %v got %v", nodes[j].Id, j, node.Id)
+				}
+			}
+		}
+	}
+}
+
+func TestBucketListRounds(t *testing.T) {
+	bl := &BucketList{
+		K:         2,
+		Sort:      RingSorter,
+		LocalNode: &Node{},
+		Rand:      rand.New(rand.NewSource(1)),
+	}
+	nodes := []*InternalNode{}
+	for id := uint64(1); id <= 30; id += 1 {
+		nodes = append(nodes, &InternalNode{Node: Node{Id: id}})
+	}
+	bl.Add(nodes...)
+
+	// partway through the round of the far bucket
+	far := bl.buckets[1]
+	seen := map[uint64]bool{}
+	for far.next < far.Len()/2 {
+		seen[far.Next().Id] = true
+	}
+
+	// remove the last selected node and an unselected node
+	selected, unselected := far.nodes[far.next-1], far.nodes[far.Len()-1]
+	bl.Remove(selected, unselected)
+	delete(seen, selected.Id)
+
+	// add a node to the far bucket
+	added := &InternalNode{Node: Node{Id: 31}}
+	bl.Add(added)
+	if _, ok := far.index[added.Id]; !ok {
+		t.Fatalf("expected node %v in the far bucket", added.Id)
+	}
+
+	// finish the round, selecting each remaining node once
+	for far.next < far.Len() {
+		node := far.Next()
+		if seen[node.Id] {
+			t.Fatalf("node %v selected twice in a round", node.Id)
+		} else if node == selected || node == unselected {
+			t.Fatalf("removed node %v selected", node.Id)
+		}
+		seen[node.Id] = true
+	}
+	if len(seen) != far.Len() {
+		t.Fatalf("expected %v nodes selected got %v", far.Len(), len(seen))
+	}
+	if !seen[added.Id] {
+		t.Fatalf("expected added node %v to be selected", added.Id)
+	}
+}
@@ -0,0 +1,115 @@
+package swim
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const kChangeLogLen = 1024
+
+// The error returned when the changes since a version are no longer in the
+// change log, or the version is from the future. The consumer should catch
+// up from a snapshot instead.
+var ErrChangesUnavailable = errors.New("membership changes unavailable")
+
+// A change records a membership update of a node, including the local node.
+type Change struct {
+	Version uint64    // Membership version after the change
+	Node    Node      // Node after the change
+	Time    time.Time // Time of the change
+}
+
+// A change log keeps a bounded list of the most recent membership changes,
+// numbered by a monotonically increasing version, and signals the waiters
+// on each change. The methods are safe to run concurrently.
+type changeLog struct {
+	l       sync.Mutex
+	version uint64        // Version of the last change
+	changes []Change      // Most recent changes in version order
+	changed chan struct{} // Closed on the next change, if not nil
+}
+
+// Record a change to the node, returning the new version. At most max
+// changes are kept, or 1024 if zero.
+func (c *changeLog) record(node Node, max int) uint64 {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if max <= 0 {
+		max = kChangeLogLen
+	}
+
+	c.version += 1
+	c.changes = append(c.changes, Change{
+		Version: c.version,
+		Node:    node,
+		Time:    time.Now(),
+	})
+
+	// drop the oldest changes, copying to release them in amortized O(1)
+	// time
+	if len(c.changes) >= 2*max {
+		c.changes = append([]Change(nil), c.changes[len(c.changes)-max:]...)
+	}
+
+	// signal the waiters
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+
+	return c.version
+}
+
+// Get the changes after the given version, which must not be older than
+// the oldest change in the log, with at most max changes kept.
+func (c *changeLog) since(version uint64, max int) ([]Change, uint64, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if max <= 0 {
+		max = kChangeLogLen
+	}
+
+	// only the last max changes are guaranteed to be kept
+	changes := c.changes
+	if len(changes) > max {
+		changes = changes[len(changes)-max:]
+	}
+
+	if version > c.version {
+		return nil, c.version, ErrChangesUnavailable
+	} else if version == c.version {
+		return nil, c.version, nil
+	} else if version+1 < changes[0].Version {
+		return nil, c.version, ErrChangesUnavailable
+	}
+
+	changes = changes[len(changes)-int(c.version-version):]
+	return append([]Change(nil), changes...), c.version, nil
+}
+
+// Wait until the version is newer than the given version, returning the new
+// version, or until the context is done.
+func (c *changeLog) wait(ctx context.Context, version uint64) (uint64, error) {
+	for {
+		c.l.Lock()
+		if c.version > version {
+			c.l.Unlock()
+			return c.version, nil
+		}
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.l.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return version, ctx.Err()
+		}
+	}
+}
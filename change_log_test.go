@@ -0,0 +1,83 @@
+package swim
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestChangeLog(t *testing.T) {
+	var c changeLog
+
+	testChanges := func(version uint64, expect uint64, ids ...uint64) {
+		changes, v, err := c.since(version, 4)
+		if err != nil {
+			t.Fatal(err)
+		} else if v != expect {
+			t.Fatalf("expected version %v got %v", expect, v)
+		} else if len(changes) != len(ids) {
+			t.Fatalf("expected %v changes got %v", len(ids), changes)
+		}
+		for i, change := range changes {
+			if change.Node.Id != ids[i] || change.Version != version+uint64(i)+1 {
+				t.Fatalf("expected node %v at version %v got %v", ids[i], version+uint64(i)+1, change)
+			}
+		}
+	}
+
+	// no changes
+	testChanges(0, 0)
+	if _, _, err := c.since(1, 4); err != ErrChangesUnavailable {
+		t.Fatalf("expected %v got %v", ErrChangesUnavailable, err)
+	}
+
+	for id := uint64(1); id <= 3; id += 1 {
+		if v := c.record(Node{Id: id}, 4); v != id {
+			t.Fatalf("expected version %v got %v", id, v)
+		}
+	}
+	testChanges(0, 3, 1, 2, 3)
+	testChanges(2, 3, 3)
+	testChanges(3, 3)
+
+	// bounded log
+	for id := uint64(4); id <= 10; id += 1 {
+		c.record(Node{Id: id}, 4)
+	}
+	if len(c.changes) >= 8 {
+		t.Fatalf("expected fewer than 8 changes kept got %v", len(c.changes))
+	}
+	testChanges(6, 10, 7, 8, 9, 10)
+	if _, _, err := c.since(5, 4); err != ErrChangesUnavailable {
+		t.Fatalf("expected %v got %v", ErrChangesUnavailable, err)
+	}
+
+	// already changed
+	if v, err := c.wait(context.Background(), 9); err != nil || v != 10 {
+		t.Fatalf("expected version 10 got %v %v", v, err)
+	}
+
+	// timed out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.wait(ctx, 10); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v got %v", context.DeadlineExceeded, err)
+	}
+
+	// woken by a change
+	done := make(chan uint64)
+	go func() {
+		v, _ := c.wait(context.Background(), 10)
+		done <- v
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.record(Node{Id: 11}, 4)
+	select {
+	case v := <-done:
+		if v != 11 {
+			t.Fatalf("expected version 11 got %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected to be woken by the change")
+	}
+}
@@ -1,5 +1,9 @@
 package swim
 
+import (
+	"reflect"
+)
+
 // A codec handles message encoding as sent over the transport
 // implementation.
 type Codec interface {
@@ -14,3 +18,163 @@ type Codec interface {
 	// CodedMessage.
 	Encode(message *CodedMessage) error
 }
+
+// A sizing codec estimates the encoded size of a message as events are
+// added to it, allowing the broker to pack broadcasts into a message up to
+// the maximum message length without encoding the message for each event.
+type SizingCodec interface {
+	Codec
+
+	// Create a sizer for the given message. The sizer must not modify the
+	// message.
+	NewSizer(message *Message) (Sizer, error)
+}
+
+// A sizer estimates the encoded size of a message as events are added to
+// it. The broker measures the message with Encode when the estimate nears
+// the maximum message length, so estimates should err on the large side.
+type Sizer interface {
+
+	// Add an event and report the estimated encoded size of the message with
+	// the events added so far.
+	Add(event interface{}) (int, error)
+
+	// Replace the estimate with the size produced by Encode for the message
+	// with the events added so far.
+	Measured(size int)
+}
+
+// Slack for the length prefixes of a message growing with its events.
+const kSizerSlack = 4
+
+// An event sizer estimates the size of a message by encoding each added
+// event once in a small message of at most three events, so that the cost
+// of sizing does not grow with the message. An event adds its size in a
+// message that already has events of its type, while the first event of
+// each type also pays for the type information sent once per message.
+// Wrapping codecs bound the expansion of the estimated size by their own
+// encoding.
+type eventSizer struct {
+	codec    Codec
+	expand   func(n int) int              // Bound on the size after wrapping
+	empty    int                          // Size of a message without events
+	first    *sizedEvent                  // First event of the message
+	types    map[reflect.Type]*sizedEvent // Events by type after the first
+	given    map[reflect.Type]interface{} // Events by type of the message
+	measured int                          // Size last measured by the broker
+	added    int                          // Size added since the last measure
+}
+
+// An event with the size of a message containing the first event of the
+// message and the event.
+type sizedEvent struct {
+	event interface{}
+	size  int
+}
+
+// Create a sizer that encodes the events of the message with the codec, and
+// bounds the estimated size with the expand function, if not nil.
+func newEventSizer(codec Codec, message *Message, expand func(n int) int) (*eventSizer, error) {
+	s := &eventSizer{
+		codec:  codec,
+		expand: expand,
+		types:  make(map[reflect.Type]*sizedEvent),
+		given:  make(map[reflect.Type]interface{}),
+	}
+
+	// measure the message as given
+	var err error
+	if s.empty, err = s.encode(); err != nil {
+		return nil, err
+	} else if s.added, err = s.encode(message.Events()...); err != nil {
+		return nil, err
+	}
+	if events := message.Events(); len(events) > 0 {
+		s.first = &sizedEvent{events[0], 0}
+		if s.first.size, err = s.encode(events[0]); err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			s.given[reflect.TypeOf(event)] = event
+		}
+	}
+
+	return s, nil
+}
+
+// Implementation of Sizer.Add()
+func (s *eventSizer) Add(event interface{}) (int, error) {
+
+	// remove indirection
+	var m Message
+	m.AddEvent(event)
+	event = m.EventList[0]
+	t := reflect.TypeOf(event)
+
+	// the first event pays for the type information common to all events
+	if s.first == nil {
+		size, err := s.encode(event)
+		if err != nil {
+			return 0, err
+		}
+		s.first = &sizedEvent{event, size}
+		s.given[t] = event
+		s.added += size - s.empty
+		return s.estimate(), nil
+	}
+
+	// pair an event of each type with the first event
+	sized, ok := s.types[t]
+	if !ok {
+		given, ok := s.given[t]
+		if !ok {
+			// the first event of a type pays for its type information
+			size, err := s.encode(s.first.event, event)
+			if err != nil {
+				return 0, err
+			}
+			s.types[t] = &sizedEvent{event, size}
+			s.given[t] = event
+			s.added += size - s.first.size
+			return s.estimate(), nil
+		}
+		size, err := s.encode(s.first.event, given)
+		if err != nil {
+			return 0, err
+		}
+		sized = &sizedEvent{given, size}
+		s.types[t] = sized
+	}
+
+	// later events of a type add only their own encoding
+	size, err := s.encode(s.first.event, sized.event, event)
+	if err != nil {
+		return 0, err
+	}
+	s.added += size - sized.size
+	return s.estimate(), nil
+}
+
+// Implementation of Sizer.Measured()
+func (s *eventSizer) Measured(size int) {
+	s.measured = size
+	s.added = 0
+}
+
+// Estimate the size of the message.
+func (s *eventSizer) estimate() int {
+	n := s.added + kSizerSlack
+	if s.expand != nil {
+		n = s.expand(n)
+	}
+	return s.measured + n
+}
+
+// Encode a message with the events to measure its size.
+func (s *eventSizer) encode(events ...interface{}) (int, error) {
+	coded := CodedMessage{Message: Message{EventList: events}}
+	if err := s.codec.Encode(&coded); err != nil {
+		return 0, err
+	}
+	return coded.Size, nil
+}
@@ -93,3 +93,57 @@ func testCodec(t *testing.T, codec Codec) {
 	msg.AddEvent(UserEvent{From: 13, Incarnation: Seq(29), Data: 1999})
 	test()
 }
+
+func testSizer(t *testing.T, codec SizingCodec, slack int) {
+	msg := new(Message)
+	msg.AddEvent(AckEvent{From: 13, Time: time.Unix(0, 9)})
+
+	sizer, err := codec.NewSizer(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coded := &CodedMessage{Message: *msg}
+	coded.Message.EventList = append([]interface{}(nil), msg.Events()...)
+	for i := 0; i < 200; i += 1 {
+		var event interface{}
+		switch i % 4 {
+		case 0:
+			event = &DeathEvent{From: 13, Id: uint64(i), Incarnation: Seq(i)}
+		case 1:
+			event = SuspectEvent{From: 13, Id: uint64(i) << 20, Incarnation: Seq(i)}
+		case 2:
+			event = &AliveEvent{From: 13, Node: Node{Id: uint64(i), Addrs: []string{"node"}}}
+		case 3:
+			event = UserEvent{From: 13, Incarnation: Seq(i), Data: i}
+		}
+
+		estimate, err := sizer.Add(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coded.Message.AddEvent(event)
+		if err := codec.Encode(coded); err != nil {
+			t.Fatal(err)
+		}
+
+		// the estimate must not fall short of the encoded size, and may
+		// only exceed it by the slack once measured after the first event
+		// of each type, which may count shared type information again
+		if estimate < coded.Size {
+			t.Fatalf("Expected estimate of at least %v got %v after %v events", coded.Size, estimate, i+1)
+		} else if slack >= 0 && i > 3 && estimate > coded.Size+slack {
+			t.Fatalf("Expected estimate of at most %v got %v after %v events", coded.Size+slack, estimate, i+1)
+		}
+
+		// measure the message now and then
+		if i%50 == 3 {
+			sizer.Measured(coded.Size)
+		}
+	}
+
+	// the sizer must not modify the message
+	if len(msg.Events()) != 1 {
+		t.Fatalf("Expected message to be unmodified")
+	}
+}
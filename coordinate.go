@@ -0,0 +1,144 @@
+package swim
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	kCoordinateDimensions = 8     // Dimensions of the Euclidean space
+	kCoordinateMaxError   = 1.5   // Initial and maximum relative error
+	kCoordinateMinHeight  = 10e-6 // Minimum height, in seconds
+	kCoordinateCe         = 0.25  // Tuning constant for the error estimate
+	kCoordinateCc         = 0.25  // Tuning constant for the coordinate
+)
+
+// A coordinate places a node in a Vivaldi network coordinate space, so that
+// the distance between the coordinates of two nodes estimates the round-trip
+// time between them. The formulation is from Vivaldi: A Decentralized
+// Network Coordinate System by Dabek et al., using a Euclidean space with
+// heights to model the access links of the nodes.
+type Coordinate struct {
+	Vec    []float64 // Position in the Euclidean space, in seconds
+	Height float64   // Height above the Euclidean space, in seconds
+	Error  float64   // Estimated relative error of the coordinate
+}
+
+// Create a coordinate at the origin with the maximum error.
+func NewCoordinate() *Coordinate {
+	return &Coordinate{
+		Vec:    make([]float64, kCoordinateDimensions),
+		Height: kCoordinateMinHeight,
+		Error:  kCoordinateMaxError,
+	}
+}
+
+// Get a copy of the coordinate.
+func (c *Coordinate) Clone() *Coordinate {
+	if c == nil {
+		return nil
+	}
+	that := *c
+	that.Vec = append([]float64(nil), c.Vec...)
+	return &that
+}
+
+// Determine if the coordinate is well-formed and in the same space as this
+// coordinate.
+func (c *Coordinate) Compatible(that *Coordinate) bool {
+	if c == nil || that == nil || len(c.Vec) != len(that.Vec) {
+		return false
+	}
+	for _, x := range that.Vec {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return false
+		}
+	}
+	return !math.IsNaN(that.Height) && !math.IsInf(that.Height, 0) &&
+		!math.IsNaN(that.Error) && !math.IsInf(that.Error, 0)
+}
+
+// Estimate the round-trip time to the node at the given coordinate.
+func (c *Coordinate) DistanceTo(that *Coordinate) time.Duration {
+	d := c.distance(that)
+	return time.Duration(d * float64(time.Second))
+}
+
+// Update the coordinate using a RTT sample to the node at the given
+// coordinate. The random source, or the global source if nil, chooses the
+// direction in which to move when the coordinates coincide.
+func (c *Coordinate) Update(that *Coordinate, rtt time.Duration, r *rand.Rand) {
+	sample := rtt.Seconds()
+	if sample <= 0 || !c.Compatible(that) {
+		return
+	}
+
+	// weight the sample by the relative confidence in the coordinates
+	total := c.Error + that.Error
+	if total <= 0 {
+		return
+	}
+	w := c.Error / total
+
+	// update the error estimate
+	dist := c.distance(that)
+	relErr := math.Abs(dist-sample) / sample
+	c.Error = kCoordinateCe*w*relErr + c.Error*(1.0-kCoordinateCe*w)
+	if c.Error > kCoordinateMaxError {
+		c.Error = kCoordinateMaxError
+	}
+
+	// move towards or away from the other node
+	force := kCoordinateCc * w * (sample - dist)
+	unit, mag := unitVector(c.Vec, that.Vec, r)
+	for i := range c.Vec {
+		c.Vec[i] += unit[i] * force
+	}
+	if mag > 0 {
+		c.Height += (c.Height + that.Height) * force / mag
+	}
+	if c.Height < kCoordinateMinHeight {
+		c.Height = kCoordinateMinHeight
+	}
+}
+
+// Calculate the distance to the given coordinate, in seconds.
+func (c *Coordinate) distance(that *Coordinate) float64 {
+	sum := 0.0
+	for i := range c.Vec {
+		d := c.Vec[i] - that.Vec[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum) + c.Height + that.Height
+}
+
+// Get the unit vector pointing from b to a and the distance between them. If
+// the points coincide, a random unit vector and zero distance are returned.
+func unitVector(a, b []float64, r *rand.Rand) ([]float64, float64) {
+	unit := make([]float64, len(a))
+	sum := 0.0
+	for i := range a {
+		unit[i] = a[i] - b[i]
+		sum += unit[i] * unit[i]
+	}
+	if mag := math.Sqrt(sum); mag > 1e-9 {
+		for i := range unit {
+			unit[i] /= mag
+		}
+		return unit, mag
+	}
+
+	// pick a random direction
+	sum = 0.0
+	for i := range unit {
+		unit[i] = randFloat64(r) - 0.5
+		sum += unit[i] * unit[i]
+	}
+	if mag := math.Sqrt(sum); mag > 0 {
+		for i := range unit {
+			unit[i] /= mag
+		}
+	}
+	return unit, 0
+}
@@ -0,0 +1,79 @@
+package swim
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestCoordinate(t *testing.T) {
+	c := NewCoordinate()
+	if d, u := c.DistanceTo(c), time.Duration(2*kCoordinateMinHeight*float64(time.Second)); d != u {
+		t.Fatalf("Expected distance %v got %v", u, d)
+	}
+
+	that := c.Clone()
+	that.Vec[0] = 1
+	if c.Vec[0] != 0 {
+		t.Fatalf("Expected a copy of the coordinate")
+	}
+
+	if !c.Compatible(that) {
+		t.Fatalf("Expected compatible coordinates")
+	} else if c.Compatible(&Coordinate{Vec: []float64{1}}) {
+		t.Fatalf("Expected incompatible dimensions")
+	} else if that.Vec[1] = math.NaN(); c.Compatible(that) {
+		t.Fatalf("Expected incompatible NaN coordinate")
+	} else if c.Compatible(nil) {
+		t.Fatalf("Expected incompatible nil coordinate")
+	}
+}
+
+func TestCoordinateConvergence(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// nodes on a grid, 10ms apart
+	type point struct{ x, y float64 }
+	points := []point{}
+	for x := 0; x < 4; x += 1 {
+		for y := 0; y < 4; y += 1 {
+			points = append(points, point{float64(x), float64(y)})
+		}
+	}
+	rtt := func(i, j int) time.Duration {
+		dx, dy := points[i].x-points[j].x, points[i].y-points[j].y
+		return time.Duration(math.Sqrt(dx*dx+dy*dy) * float64(10*time.Millisecond))
+	}
+
+	coords := make([]*Coordinate, len(points))
+	for i := range coords {
+		coords[i] = NewCoordinate()
+	}
+
+	// random probes
+	for round := 0; round < 2000; round += 1 {
+		for i := range coords {
+			j := r.Intn(len(coords))
+			if i != j {
+				coords[i].Update(coords[j].Clone(), rtt(i, j), r)
+			}
+		}
+	}
+
+	// estimates within 2ms of the actual RTT
+	for i := range coords {
+		for j := range coords {
+			if i == j {
+				continue
+			}
+			actual, estimate := rtt(i, j), coords[i].DistanceTo(coords[j])
+			if diff := estimate - actual; diff > 2*time.Millisecond || diff < -2*time.Millisecond {
+				t.Fatalf("Expected RTT %v from %v to %v got %v", actual, i, j, estimate)
+			}
+		}
+		if coords[i].Error > 0.2 {
+			t.Fatalf("Expected small error got %v", coords[i].Error)
+		}
+	}
+}
@@ -1,13 +1,23 @@
 package swim
 
 import (
+	"context"
 	"log"
+	"math"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 const kBufferSize = 8
+const kDigestBatch = 8
+
+// Identifies user events that have already been seen.
+type userEventKey struct {
+	From        uint64
+	Incarnation Seq
+}
 
 // Detector implements the SWIM failure detector. Remember to close the
 // detector before discarding it to free resources.
@@ -25,7 +35,26 @@ type Detector struct {
 	actives     map[uint64]bool
 	activeList  []Node
 	activeCount int64
+	viewHash    uint64
 	suspects    map[uint64]*InternalNode
+	userEvents  map[userEventKey]time.Time
+
+	// The membership snapshot for lock-free readers and the log of the
+	// changes between snapshots.
+	snapshot atomic.Value
+	changes  changeLog
+
+	// The trace for the next state broadcast and whether it is forwarded,
+	// when re-broadcasting.
+	tracing  *Trace
+	relaying bool
+
+	// The notifications to send once the message being handled has been
+	// handled and the lock released.
+	notifications []func()
+
+	// The network coordinate of the local node, if enabled.
+	coord *Coordinate
 
 	// States for signaling the event loop.
 	state    int
@@ -34,6 +63,7 @@ type Detector struct {
 	stopped  chan struct{}
 	joins    chan []string
 	period   time.Time
+	digested time.Time
 
 	// Concurrency control.
 	l sync.Mutex
@@ -43,13 +73,21 @@ type Detector struct {
 	// must be sufficiently distinct to allow messages to be routed to the
 	// appropriate node ID. A transport may accept messages for multiple nodes
 	// so long as it routes those messages appropriately. The local node must
-	// not be accessed when the Detector is running.
+	// not be accessed when the Detector is running; use UpdateLocalNode to
+	// change its addresses or user data.
 	LocalNode Node
 
 	// The number of direct probes to send per protocol period. The algorithm
 	// described in the SWIM paper uses one direct probe per protocol period.
 	DirectProbes uint
 
+	// The maximum number of direct probes to send per protocol period while
+	// broadcasts are backlogged. If greater than DirectProbes, the number of
+	// direct probes scales with the number of messages needed to piggyback
+	// the queued broadcasts, so that backlogs drain quickly after bursts.
+	// Otherwise, DirectProbes probes are always sent.
+	MaxDirectProbes uint
+
 	// The number of indirect probes to send after a node fails to reply to
 	// the direct probe. This is equivalent to the k parameter in the SWIM
 	// paper.
@@ -70,6 +108,27 @@ type Detector struct {
 	// above by 1/3 of the probe interval.
 	ProbeTimeout time.Duration
 
+	// The gossip interval controls the time between gossip rounds, in which
+	// queued broadcasts are sent to GossipNodes random live nodes without
+	// probing them. Gossip speeds up dissemination without sending more
+	// probes. Rounds are skipped when no broadcasts are queued. Gossip is
+	// disabled if either parameter is zero.
+	GossipInterval time.Duration
+
+	// The number of nodes to send broadcasts to per gossip round.
+	GossipNodes uint
+
+	// The digest interval controls how often a digest of the membership view
+	// is piggybacked on a probe. A node receiving a digest that differs from
+	// its own view requests the entries in the differing buckets from the
+	// sender, repairing the state broadcasts it missed. Digests are disabled
+	// if zero.
+	DigestInterval time.Duration
+
+	// The number of buckets in the membership digest, which must be the same
+	// for all nodes. If zero, 16 buckets are used.
+	DigestBuckets uint
+
 	// The retransmission multiplier controls how many times broadcast events
 	// are retransmitted. The limit is calculated as
 	//
@@ -94,18 +153,61 @@ type Detector struct {
 	// outside the detector.
 	Codec Codec
 
-	// The SelectionList implementation to use. The instance must not be
-	// accessed outside the detector.
+	// If true, piggyback broadcasts on messages up to the maximum message
+	// length, measuring each broadcast with the Codec, which must implement
+	// SizingCodec. Otherwise, the number of broadcasts is estimated.
+	PackBroadcasts bool
+
+	// The maximum number of queued broadcasts, or 0 if unbounded. When the
+	// queue is full, broadcasts are evicted by the BroadcastEviction policy.
+	// Membership broadcasts are never evicted for user events.
+	MaxBroadcasts int
+
+	// The policy for evicting broadcasts from a full broadcast queue.
+	BroadcastEviction EvictionPolicy
+
+	// The SelectionList implementation to use. If nil, a ShuffleList is
+	// used. The instance must not be accessed outside the detector.
 	SelectionList SelectionList
 
+	// The source of randomness for the default selection list, which is a
+	// ShuffleList if SelectionList is nil. If nil, the global source is
+	// used. The instance must not be accessed outside the detector.
+	Rand *rand.Rand
+
 	// If not nil, log receipt of messages.
 	Logger *log.Logger
 
 	// If not nil, channel on which to send nodes when they are updated.
 	UpdateCh chan Node
 
+	// The number of membership changes to keep for ChangesSince. If zero,
+	// 1024 changes are kept.
+	ChangeLogLen int
+
 	// If not nil, channel on which to send messages received by this node.
 	MessageCh chan Message
+
+	// If not nil, attach application payloads to acks and receive the
+	// payloads and RTTs of the acks to the pings of this node.
+	PingDelegate PingDelegate
+
+	// If true, maintain a Vivaldi network coordinate for the local node from
+	// the RTT samples of direct probes, and exchange coordinates on pings and
+	// acks, so that the RTT between any two members can be estimated.
+	Coordinates bool
+
+	// If true, include the view hash of this node in acks, so that probing
+	// nodes can detect divergent membership views.
+	AckViewHash bool
+
+	// If true, attach propagation traces to the broadcasts originating from
+	// this node. Traces received with broadcasts are always forwarded.
+	TraceBroadcasts bool
+
+	// If not nil, channel on which to send the first receipt of each traced
+	// broadcast, after handling the message that carried it.
+	TraceCh chan BroadcastTrace
 }
 
 // Start the failure detector.
@@ -116,9 +218,16 @@ func (d *Detector) Start() {
 
 		// create broker
 		d.broker = NewBroker(d.Transport, d.Codec)
+		d.broker.Packing = d.PackBroadcasts
+		d.broker.LimitFunc = d.retransmitLimit
+		d.broker.Broadcasts.MaxLen = d.MaxBroadcasts
+		d.broker.Broadcasts.Policy = d.BroadcastEviction
 
 		// save selection list
 		d.nodes = d.SelectionList
+		if d.nodes == nil {
+			d.nodes = &ShuffleList{Rand: d.Rand}
+		}
 
 		// create channels
 		d.stopping = make(chan struct{}, 1)
@@ -129,6 +238,12 @@ func (d *Detector) Start() {
 		d.nodeMap = make(map[uint64]*InternalNode)
 		d.actives = make(map[uint64]bool)
 		d.suspects = make(map[uint64]*InternalNode)
+		d.userEvents = make(map[userEventKey]time.Time)
+
+		// create network coordinate
+		if d.Coordinates {
+			d.coord = NewCoordinate()
+		}
 	}
 
 	// don't call multiple times!
@@ -139,10 +254,12 @@ func (d *Detector) Start() {
 	// flag as started
 	d.state += 1
 	d.started = true
+	d.broker.Start()
 
 	// update local node state
 	d.LocalNode.State = Alive
 	d.LocalNode.Incarnation.Witness(d.incarnation.Increment())
+	d.publish(nil)
 
 	// receive messages asynchronously
 	go d.recv()
@@ -167,6 +284,9 @@ func (d *Detector) Stop() {
 	// receive acknowledgement
 	<-d.stopped
 
+	// release synchronous broadcasts
+	d.broker.Stop()
+
 	// the message receiver won't stop until a message is received...
 	d.started = false
 }
@@ -232,6 +352,7 @@ func (d *Detector) Leave() {
 	// we're dead
 	d.LocalNode.Incarnation.Witness(d.incarnation.Increment())
 	d.LocalNode.State = Dead
+	d.publish(nil)
 
 	// broadcast death event to invalidate old broadcasts
 	event := d.deathNode(&d.LocalNode)
@@ -252,15 +373,94 @@ func (d *Detector) Leave() {
 // Broadcast an event asynchronously. If the detector is not running, the
 // broadcast will be sent when the detector is started.
 func (d *Detector) Broadcast(event BroadcastEvent) {
-	d.broker.Broadcast(event)
+	d.broker.Broadcast(d.originate(event))
+}
+
+// Broadcast an event asynchronously with the given options, for example to
+// send an event more or fewer times than membership broadcasts. The event
+// never takes priority over membership broadcasts: classes below 2 are
+// raised to 2. If the detector is not running, the broadcast will be sent
+// when the detector is started.
+func (d *Detector) BroadcastWithOptions(event BroadcastEvent, opts BroadcastOptions) {
+	d.broker.BroadcastWithOptions(d.originate(event), opts)
 }
 
 // Broadcast an event and wait for the broadcast to be removed from the
-// queue, either from invalidation or after reaching the broadcast
-// transmission limit. If the detector is not running or there are no nodes
-// other than the local node, the call will block indefinitely.
-func (d *Detector) BroadcastSync(event BroadcastEvent) {
-	<-d.broker.BroadcastSync(event)
+// queue, either from invalidation, eviction, or after reaching the broadcast
+// transmission limit, or for the detector to stop. If the detector was
+// stopped, the call returns immediately with the stopped reason and the
+// broadcast is sent when the detector is started again. If there are no
+// nodes other than the local node, the call will block indefinitely; use
+// BroadcastSyncContext to time out.
+func (d *Detector) BroadcastSync(event BroadcastEvent) BroadcastResult {
+	result, _ := d.BroadcastSyncContext(context.Background(), event)
+	return result
+}
+
+// Broadcast an event and wait as for BroadcastSync until the context is
+// done. If the context is done first, the broadcast remains queued and the
+// context error is returned.
+func (d *Detector) BroadcastSyncContext(ctx context.Context, event BroadcastEvent) (BroadcastResult, error) {
+	select {
+	case result := <-d.broker.BroadcastSync(d.originate(event)):
+		return result, nil
+	case <-ctx.Done():
+		return BroadcastResult{}, ctx.Err()
+	}
+}
+
+// Update the local node with the function, which may change the addresses
+// and the user data of the node, and broadcast the change to the group with
+// a new incarnation. The function runs under the lock of the detector, so
+// it must not call the detector. If the detector is not running, including
+// after leaving the group, the change is only applied locally and is sent
+// when the detector joins the group.
+func (d *Detector) UpdateLocalNode(fn func(node *Node)) {
+	if event := d.updateLocalNode(fn); event != nil {
+		d.Broadcast(event)
+	}
+}
+
+// Update the local node as for UpdateLocalNode and wait for the broadcast
+// of the change to be removed from the queue as for BroadcastSyncContext,
+// by which time the change has most likely propagated to the group. If the
+// detector is not running, the call returns without waiting.
+func (d *Detector) UpdateLocalNodeSync(ctx context.Context, fn func(node *Node)) (BroadcastResult, error) {
+	if event := d.updateLocalNode(fn); event != nil {
+		return d.BroadcastSyncContext(ctx, event)
+	}
+	return BroadcastResult{}, nil
+}
+
+// Set the user data of the local node as for UpdateLocalNode.
+func (d *Detector) SetUserData(data interface{}) {
+	d.UpdateLocalNode(func(node *Node) {
+		node.UserData = data
+	})
+}
+
+// Apply the update to the local node, returning the alive event to
+// broadcast, or nil if the detector is not running or has left the group.
+func (d *Detector) updateLocalNode(fn func(node *Node)) *AliveEvent {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	// the function may only change the addresses and the user data
+	node := d.LocalNode
+	fn(&node)
+	d.LocalNode.Addrs = node.Addrs
+	d.LocalNode.UserData = node.UserData
+
+	// not running, or left the group, so there is nothing to supersede
+	// until the detector joins the group
+	if !d.started || d.LocalNode.State == Dead {
+		return nil
+	}
+
+	// supersede the previous state of the local node
+	d.LocalNode.Incarnation.Witness(d.incarnation.Increment())
+	d.publish(nil)
+	return d.aliveNode(&d.LocalNode)
 }
 
 // Retrieve a list of member nodes that have not been marked as dead. The
@@ -284,12 +484,130 @@ func (d *Detector) Members() []Node {
 	return nodes
 }
 
+// Get a snapshot of the membership, including the local node and the nodes
+// declared dead, without locking. The snapshot is empty until the detector
+// is started.
+func (d *Detector) Snapshot() *Snapshot {
+	if s, ok := d.snapshot.Load().(*Snapshot); ok {
+		return s
+	}
+	return &Snapshot{}
+}
+
+// Get the node with the given ID, which may be the local node or a dead
+// node, without locking.
+func (d *Detector) Member(id uint64) (Node, bool) {
+	return d.Snapshot().Member(id)
+}
+
+// Get the nodes, including the local node, in any of the given states,
+// without locking.
+func (d *Detector) MembersByState(states ...State) []Node {
+	return d.Snapshot().MembersByState(states...)
+}
+
+// Get the nodes, including the local node, for which the predicate returns
+// true, without locking. See HasTags for filtering by the tags in the user
+// data of the nodes.
+func (d *Detector) MembersWhere(predicate func(node *Node) bool) []Node {
+	return d.Snapshot().Filter(predicate)
+}
+
+// Get the membership changes after the given version, such as the version
+// of a snapshot, and the version of the last change. If the changes are no
+// longer in the change log, ErrChangesUnavailable is returned, and the
+// consumer should catch up from a new snapshot.
+func (d *Detector) ChangesSince(version uint64) ([]Change, uint64, error) {
+	return d.changes.since(version, d.ChangeLogLen)
+}
+
+// Wait until the membership version is newer than the given version,
+// returning the new version, or until the context is done.
+func (d *Detector) WaitForChange(ctx context.Context, version uint64) (uint64, error) {
+	return d.changes.wait(ctx, version)
+}
+
+// Record a change to the local node or the given node, if not nil, and
+// replace the membership snapshot with an updated copy.
+func (d *Detector) publish(node *InternalNode) {
+	s, _ := d.snapshot.Load().(*Snapshot)
+
+	// record the change before publishing the snapshot, so that the changes
+	// since the version of any snapshot are in the change log
+	if node == nil {
+		version := d.changes.record(d.LocalNode, d.ChangeLogLen)
+		d.snapshot.Store(s.with(version, d.LocalNode, nil))
+	} else {
+		version := d.changes.record(node.Node, d.ChangeLogLen)
+		d.snapshot.Store(s.with(version, d.LocalNode, &node.Node))
+	}
+}
+
 // Estimate the number of member nodes that have not been marked as dead,
 // excluding the local node.
 func (d *Detector) ActiveCount() int {
 	return int(atomic.LoadInt64(&d.activeCount))
 }
 
+// Get the hash of the membership view of this node: the XOR of the hashes
+// of the (id, incarnation, state) entries of the live nodes, including the
+// local node in its current state, as in the digest of the view. Nodes with
+// the same view have the same hash.
+func (d *Detector) ViewHash() uint64 {
+	local := entryHash(d.LocalNode.Id, d.LocalNode.Incarnation.Get(), d.LocalNode.State)
+	return atomic.LoadUint64(&d.viewHash) ^ local
+}
+
+// Get a copy of the network coordinate of the local node, or nil if
+// coordinates are disabled.
+func (d *Detector) Coordinate() *Coordinate {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return d.coord.Clone()
+}
+
+// Estimate the round-trip time between the nodes with the given IDs, either
+// of which may be the local node, from their network coordinates. The
+// estimate is unavailable if coordinates are disabled or the coordinate of
+// either node is unknown.
+func (d *Detector) EstimateRTT(a, b uint64) (time.Duration, bool) {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	ca, cb := d.coordinateOf(a), d.coordinateOf(b)
+	if !ca.Compatible(cb) {
+		return 0, false
+	}
+	return ca.DistanceTo(cb), true
+}
+
+// Get the last known network coordinate of the node with the given ID.
+func (d *Detector) coordinateOf(id uint64) *Coordinate {
+	if id == d.LocalNode.Id {
+		return d.coord
+	} else if node, ok := d.nodeMap[id]; ok {
+		return node.Coord
+	}
+	return nil
+}
+
+// List the IDs of the live nodes whose view hash, as last acknowledged,
+// differs from the view hash of this node. Nodes only report their view
+// hashes if AckViewHash is set.
+func (d *Detector) DivergentNodes() (ids []uint64) {
+	d.l.Lock()
+	defer d.l.Unlock()
+
+	hash := d.ViewHash()
+	for id := range d.actives {
+		node := d.nodeMap[id]
+		if node.RemoteViewHash != 0 && node.RemoteViewHash != hash {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
+
 // Run the failure detector loop.
 func (d *Detector) loop() {
 	var probedNodes []*InternalNode
@@ -301,12 +619,25 @@ func (d *Detector) loop() {
 	timer.Stop()
 	defer timer.Stop()
 
+	// gossip only if enabled
+	var gossipC <-chan time.Time
+	if d.GossipInterval > 0 && d.GossipNodes > 0 {
+		gossip := time.NewTicker(d.GossipInterval)
+		defer gossip.Stop()
+		gossipC = gossip.C
+	}
+
 	for {
 		select {
 		case <-d.stopping: // stop signal
 			d.stopped <- struct{}{}
 			return
 
+		case <-gossipC: // gossip round
+			d.l.Lock()
+			d.gossip()
+			d.l.Unlock()
+
 		case <-timer.C: // probe timeout
 			d.l.Lock()
 			if !d.period.IsZero() && probedNodes != nil {
@@ -323,6 +654,9 @@ func (d *Detector) loop() {
 			}
 			d.period = t
 
+			// forget old user events
+			d.pruneUserEvents()
+
 			// send out the probes
 			probedNodes = d.probe()
 
@@ -344,7 +678,7 @@ func (d *Detector) probe() (nodes []*InternalNode) {
 
 	// maximum number of probes
 	max := d.nodes.Len()
-	probes := int(d.DirectProbes)
+	probes := d.directProbes()
 
 	// send the probes
 	for i, j := 0, 0; i < max && j < probes; i += 1 {
@@ -355,7 +689,14 @@ func (d *Detector) probe() (nodes []*InternalNode) {
 			d.stateUpdate(node, Dead, false)
 		} else {
 			if len(node.Addrs) > 0 {
-				d.sendTo(node, d.ping())
+				events := []interface{}{d.ping()}
+				if coord := d.coordinate(time.Time{}); coord != nil {
+					events = append(events, coord)
+				}
+				if digest := d.nextDigest(); digest != nil {
+					events = append(events, digest)
+				}
+				d.sendTo(node, events...)
 				j += 1
 			}
 			// append to send indirect request
@@ -366,6 +707,54 @@ func (d *Detector) probe() (nodes []*InternalNode) {
 	return
 }
 
+// Calculate the number of direct probes to send, scaling with the number of
+// messages needed to piggyback the queued broadcasts.
+func (d *Detector) directProbes() int {
+	probes := int(d.DirectProbes)
+	if d.MaxDirectProbes <= d.DirectProbes {
+		return probes
+	}
+
+	// unbounded messages carry the whole queue
+	perMessage := d.broker.BroadcastsPerMessage()
+	if perMessage <= 0 {
+		return probes
+	}
+
+	// one probe per message of queued broadcasts
+	need := int(math.Ceil(float64(d.broker.Pending()) / perMessage))
+	if need > int(d.MaxDirectProbes) {
+		return int(d.MaxDirectProbes)
+	} else if need > probes {
+		return need
+	}
+	return probes
+}
+
+// Send queued broadcasts to random live nodes.
+func (d *Detector) gossip() {
+
+	// skip the round if there is nothing to send
+	if d.broker.Pending() == 0 {
+		return
+	}
+
+	// collect the live nodes
+	nodes := []*InternalNode{}
+	for _, node := range d.nodes.List() {
+		if node.State != Dead && len(node.Addrs) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+
+	// send to a random subset of the nodes
+	for i, n := 0, len(nodes); i < n && i < int(d.GossipNodes); i += 1 {
+		j := i + randIntn(d.Rand, n-i)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+		d.sendTo(nodes[i])
+	}
+}
+
 // Send indirect probes.
 func (d *Detector) indirectProbe(nodes []*InternalNode) {
 
@@ -398,10 +787,17 @@ func (d *Detector) indirectProbe(nodes []*InternalNode) {
 		max = int(d.IndirectProbes)
 	}
 
+	// select the helpers separately if supported
+	next := d.nodes.Next
+	if helpers, ok := d.nodes.(HelperList); ok {
+		next = helpers.Helper
+	}
+
 	// send the indirect probe requests
 	for i := 0; i < max; {
-		if node := d.nodes.Next(); node != nil && !flags[node.Id] {
+		if node := next(); node != nil && !flags[node.Id] {
 			d.sendTo(node, requests...)
+			flags[node.Id] = true
 			i += 1
 		}
 	}
@@ -509,13 +905,28 @@ func (d *Detector) handle(msg *Message) {
 		}
 	}
 
-	// queue events
+	// queue events, comparing digests after the piggybacked broadcasts
+	var digests []interface{}
 	for _, event := range events {
+		if _, ok := event.(DigestEvent); ok {
+			digests = append(digests, event)
+		} else {
+			d.handleEvent(event)
+		}
+	}
+	for _, event := range digests {
 		d.handleEvent(event)
 	}
 
+	notifications := d.notifications
+	d.notifications = nil
 	d.l.Unlock()
 
+	// send the notifications queued by the handlers
+	for _, notify := range notifications {
+		notify()
+	}
+
 	// trigger message update
 	if d.MessageCh != nil {
 		d.MessageCh <- *msg
@@ -528,7 +939,7 @@ func (d *Detector) handleEvent(event interface{}) {
 		d.handlePing(&event)
 
 	case AckEvent:
-		d.handleAck(&event)
+		d.handleAck(&event, true)
 
 	case IndirectPingRequestEvent:
 		d.handleIndirectPingRequest(&event)
@@ -542,6 +953,15 @@ func (d *Detector) handleEvent(event interface{}) {
 	case AntiEntropyEvent:
 		d.handleAntiEntropy(&event)
 
+	case CoordinateEvent:
+		d.handleCoordinate(&event)
+
+	case DigestEvent:
+		d.handleDigest(&event)
+
+	case DigestRequestEvent:
+		d.handleDigestRequest(&event)
+
 	case AliveEvent:
 		d.handleAlive(&event)
 
@@ -578,7 +998,11 @@ func (d *Detector) handlePing(event *PingEvent) {
 	}
 
 	// acknowledge the ping
-	d.sendTo(node, d.ack(event.Time))
+	if coord := d.coordinate(event.Time); coord != nil {
+		d.sendTo(node, d.ack(event.Time), coord)
+	} else {
+		d.sendTo(node, d.ack(event.Time))
+	}
 }
 
 // Handle indirect ping requests.
@@ -627,8 +1051,9 @@ func (d *Detector) handleIndirectPing(event *IndirectPingEvent) {
 	d.sendTo(node, d.indirectAck(event.Time, via, event.ViaTime))
 }
 
-// Handle acknowledgements.
-func (d *Detector) handleAck(event *AckEvent) {
+// Handle acknowledgements, notifying the ping delegate if the ack is for a
+// ping of this node.
+func (d *Detector) handleAck(event *AckEvent, notify bool) {
 
 	// just in case, ignore acks from self
 	if event.From == d.LocalNode.Id {
@@ -651,15 +1076,29 @@ func (d *Detector) handleAck(event *AckEvent) {
 
 	// update RTT; this extends the RTT in the case of an indirect ack to
 	// reduce the likelihood of future false negatives from slow nodes
-	node.RTT.Update(time.Since(event.Time))
+	rtt := time.Since(event.Time)
+	node.RTT.Update(rtt)
 
 	// set last ack time
 	node.LastAckTime = time.Now()
 
+	// record the view of the node, if sent
+	node.RemoteViewHash = event.ViewHash
+
 	// send alive message if node isn't marked as alive
 	if node.State != Alive {
 		d.stateUpdate(node, Alive, true)
 	}
+
+	// notify the delegate once the lock is released
+	if notify && d.PingDelegate != nil {
+		delegate := d.PingDelegate
+		that := node.Node
+		payload := event.Payload
+		d.notifications = append(d.notifications, func() {
+			delegate.NotifyPingComplete(&that, rtt, payload)
+		})
+	}
 }
 
 // Handle indirect acknowledgement.
@@ -670,8 +1109,9 @@ func (d *Detector) handleIndirectAck(event *IndirectAckEvent) {
 		return
 	}
 
-	// handle the ack locally
-	d.handleAck(&event.AckEvent)
+	// handle the ack locally; the ping was sent for the requesting node, so
+	// only its delegate is notified
+	d.handleAck(&event.AckEvent, false)
 
 	// lookup the node
 	node := d.lookup(event.Via, nil)
@@ -711,6 +1151,108 @@ func (d *Detector) handleAntiEntropy(event *AntiEntropyEvent) {
 	d.stateUpdate(node, event.State, false)
 }
 
+// Handle coordinate event.
+func (d *Detector) handleCoordinate(event *CoordinateEvent) {
+
+	// just in case, ignore coordinates from self
+	if event.From == d.LocalNode.Id {
+		return
+	}
+
+	// ignore coordinates if disabled or malformed
+	if !d.coord.Compatible(&event.Coord) {
+		return
+	}
+
+	// record the coordinate of the node
+	node := d.lookup(event.From, nil)
+	node.Coord = &event.Coord
+
+	// update the local coordinate from the RTT sample of a current ack
+	if !event.Time.IsZero() && !d.period.IsZero() && !event.Time.Before(d.period) {
+		d.coord.Update(&event.Coord, time.Since(event.Time), d.Rand)
+	}
+}
+
+// Handle digest event.
+func (d *Detector) handleDigest(event *DigestEvent) {
+
+	// just in case, ignore digests from self
+	if event.From == d.LocalNode.Id {
+		return
+	}
+
+	// lookup the node
+	node := d.lookup(event.From, nil)
+
+	// can't request entries without return address
+	if len(node.Addrs) == 0 {
+		return
+	}
+
+	// request the entries in the differing buckets
+	buckets := d.digest(len(event.Digest)).Diff(event.Digest)
+	if len(buckets) > 0 {
+		d.sendTo(node, &DigestRequestEvent{
+			From:    d.LocalNode.Id,
+			Buckets: buckets,
+			Size:    len(event.Digest),
+		})
+	}
+}
+
+// Handle digest request event.
+func (d *Detector) handleDigestRequest(event *DigestRequestEvent) {
+
+	// just in case, ignore requests from self
+	if event.From == d.LocalNode.Id {
+		return
+	}
+
+	// lookup the node
+	node := d.lookup(event.From, nil)
+
+	// can't reply without return address
+	if len(node.Addrs) == 0 || event.Size <= 0 {
+		return
+	}
+
+	// find the requested buckets
+	digest := NewDigest(event.Size)
+	requested := make(map[int]bool)
+	for _, bucket := range event.Buckets {
+		requested[int(bucket)] = true
+	}
+
+	// collect the entries in the requested buckets, including dead nodes
+	events := []interface{}{}
+	if requested[digest.Bucket(d.LocalNode.Id)] {
+		events = append(events, &AliveEvent{From: d.LocalNode.Id, Node: d.LocalNode})
+	}
+	for id, that := range d.nodeMap {
+		if requested[digest.Bucket(id)] {
+			if event := d.stateEvent(that); event != nil {
+				events = append(events, event)
+			}
+		}
+	}
+
+	// reply in batches that fit in a message, sized as if each carried the
+	// anti-entropy event that sendTo may add
+	header := &Message{From: d.LocalNode.Id, To: node.Id, Incarnation: node.Incarnation}
+	header.AddEvent(d.antiEntropy(&d.LocalNode))
+	batches, err := d.broker.Batches(header, events, kDigestBatch)
+	if err != nil {
+		if d.Logger != nil {
+			d.Logger.Printf("[digest %v] Failed to size reply to node %v: %v", d.LocalNode.Id, node.Id, err)
+		}
+		return
+	}
+	for _, batch := range batches {
+		d.sendTo(node, batch...)
+	}
+}
+
 // Handle alive event.
 func (d *Detector) handleAlive(event *AliveEvent) {
 	d.handleStateBroadcast(event, event.Id, event.Incarnation, Alive)
@@ -740,6 +1282,7 @@ func (d *Detector) handleStateBroadcast(event BroadcastEvent, id uint64, incarna
 		if cmp < 0 || state != Alive {
 			// then we dispute the update
 			d.LocalNode.Incarnation.Witness(d.incarnation.Increment())
+			d.publish(nil)
 			d.Broadcast(d.aliveNode(&d.LocalNode))
 		}
 		return
@@ -749,6 +1292,7 @@ func (d *Detector) handleStateBroadcast(event BroadcastEvent, id uint64, incarna
 	node := d.lookup(id, nil)
 
 	if cmp := node.Incarnation.Compare(incarnation); cmp < 0 {
+		seen := time.Now()
 
 		// update incarnation numbers
 		node.Incarnation.Witness(incarnation)
@@ -758,8 +1302,14 @@ func (d *Detector) handleStateBroadcast(event BroadcastEvent, id uint64, incarna
 			node.Node = event.(*AliveEvent).Node
 		}
 
-		// trigger state update for this new incarnation
+		// trigger state update for this new incarnation, forwarding the trace
+		trace := traceOf(event)
+		d.tracing, d.relaying = trace.Next(), true
 		d.stateUpdate(node, state, false)
+		d.tracing, d.relaying = nil, false
+
+		// record the receipt
+		d.traced(event, trace, seen)
 
 	} else if cmp > 0 {
 
@@ -772,13 +1322,83 @@ func (d *Detector) handleStateBroadcast(event BroadcastEvent, id uint64, incarna
 // Handle user event.
 func (d *Detector) handleUserEvent(event *UserEvent) {
 
-	panic("not implemented")
+	// ignore our own events
+	if event.From == d.LocalNode.Id {
+		return
+	}
 
 	// ignore message if already seen
-	// TODO: figure out how to do this elegantly
+	key := userEventKey{event.From, event.Incarnation}
+	if _, ok := d.userEvents[key]; ok {
+		return
+	}
+	d.userEvents[key] = time.Now()
 
-	// re-broadcast
-	d.Broadcast(event)
+	// record the receipt as received
+	trace := event.Trace
+	received := *event
+	d.traced(&received, trace, d.userEvents[key])
+
+	// re-broadcast, forwarding the trace without starting a new one
+	event.Trace = trace.Next()
+	d.broker.Broadcast(event)
+}
+
+// Attach a new trace to a user event originating from this node if tracing
+// is enabled, copying the event so that the caller's event is unchanged.
+func (d *Detector) originate(event BroadcastEvent) BroadcastEvent {
+	if e, ok := event.(*UserEvent); ok && e.Trace == nil && d.TraceBroadcasts {
+		traced := *e
+		traced.Trace = NewTrace(d.LocalNode.Id)
+		return &traced
+	}
+	return event
+}
+
+// Record the first receipt of a traced broadcast, to send on the trace
+// channel once the message carrying it has been handled.
+func (d *Detector) traced(event BroadcastEvent, trace *Trace, seen time.Time) {
+	if trace == nil || d.TraceCh == nil {
+		return
+	}
+
+	record := BroadcastTrace{
+		Event:  event,
+		Origin: trace.Origin,
+		Hops:   trace.Hops + 1,
+		Sent:   trace.Time,
+		Seen:   seen,
+	}
+
+	ch := d.TraceCh
+	d.notifications = append(d.notifications, func() {
+		ch <- record
+	})
+}
+
+// Get the trace for a new state broadcast: the trace of the broadcast being
+// forwarded, which is nil if it was not traced, or a new trace if tracing is
+// enabled.
+func (d *Detector) nextTrace() *Trace {
+	if d.relaying {
+		trace := d.tracing
+		d.tracing, d.relaying = nil, false
+		return trace
+	} else if d.TraceBroadcasts {
+		return NewTrace(d.LocalNode.Id)
+	}
+	return nil
+}
+
+// Forget user events seen more than twice the suspicion duration ago, by
+// which time their broadcasts should have run their course.
+func (d *Detector) pruneUserEvents() {
+	expiry := time.Now().Add(-2 * d.SuspicionDuration())
+	for key, t := range d.userEvents {
+		if t.Before(expiry) {
+			delete(d.userEvents, key)
+		}
+	}
 }
 
 // Ping the node.
@@ -791,10 +1411,17 @@ func (d *Detector) ping() *PingEvent {
 
 // Acknowledge a ping.
 func (d *Detector) ack(t time.Time) *AckEvent {
-	return &AckEvent{
+	ack := &AckEvent{
 		From: d.LocalNode.Id,
 		Time: t,
 	}
+	if d.AckViewHash {
+		ack.ViewHash = d.ViewHash()
+	}
+	if d.PingDelegate != nil {
+		ack.Payload = d.PingDelegate.AckPayload()
+	}
+	return ack
 }
 
 // Send an indirect ping request.
@@ -836,8 +1463,9 @@ func (d *Detector) alive(node *InternalNode) *AliveEvent {
 // Broadcast news that a node is alive.
 func (d *Detector) aliveNode(node *Node) *AliveEvent {
 	return &AliveEvent{
-		From: d.LocalNode.Id,
-		Node: *node,
+		From:  d.LocalNode.Id,
+		Node:  *node,
+		Trace: d.nextTrace(),
 	}
 }
 
@@ -847,6 +1475,7 @@ func (d *Detector) suspect(node *InternalNode) *SuspectEvent {
 		From:        d.LocalNode.Id,
 		Id:          node.Id,
 		Incarnation: node.Incarnation.Get(),
+		Trace:       d.nextTrace(),
 	}
 }
 
@@ -861,9 +1490,69 @@ func (d *Detector) deathNode(node *Node) *DeathEvent {
 		From:        d.LocalNode.Id,
 		Id:          node.Id,
 		Incarnation: node.Incarnation.Get(),
+		Trace:       d.nextTrace(),
 	}
 }
 
+// Get the coordinate event to send with a ping, or with an ack of the ping
+// with the given timestamp, or nil if coordinates are disabled.
+func (d *Detector) coordinate(t time.Time) *CoordinateEvent {
+	if d.coord == nil {
+		return nil
+	}
+	return &CoordinateEvent{
+		From:  d.LocalNode.Id,
+		Time:  t,
+		Coord: *d.coord.Clone(),
+	}
+}
+
+// Get the digest event to piggyback on a probe, if one is due.
+func (d *Detector) nextDigest() *DigestEvent {
+	if d.DigestInterval <= 0 || time.Since(d.digested) < d.DigestInterval {
+		return nil
+	}
+	d.digested = time.Now()
+
+	buckets := int(d.DigestBuckets)
+	if buckets == 0 {
+		buckets = kDigestBuckets
+	}
+
+	return &DigestEvent{
+		From:   d.LocalNode.Id,
+		Digest: d.digest(buckets),
+	}
+}
+
+// Compute the digest of the membership view, including the local node.
+// Dead nodes are left out, as joining nodes never learn of past deaths.
+func (d *Detector) digest(buckets int) Digest {
+	digest := NewDigest(buckets)
+	if buckets == 0 {
+		return digest
+	}
+	digest.Add(d.LocalNode.Id, d.LocalNode.Incarnation.Get(), d.LocalNode.State)
+	for id := range d.actives {
+		node := d.nodeMap[id]
+		digest.Add(id, node.Incarnation.Get(), node.State)
+	}
+	return digest
+}
+
+// Get the state event describing the node, to send without a trace.
+func (d *Detector) stateEvent(node *InternalNode) interface{} {
+	switch node.State {
+	case Alive:
+		return &AliveEvent{From: d.LocalNode.Id, Node: node.Node}
+	case Suspect:
+		return &SuspectEvent{From: d.LocalNode.Id, Id: node.Id, Incarnation: node.Incarnation.Get()}
+	case Dead:
+		return &DeathEvent{From: d.LocalNode.Id, Id: node.Id, Incarnation: node.Incarnation.Get()}
+	}
+	return nil
+}
+
 // Send an anti-entropy event.
 func (d *Detector) antiEntropy(node *Node) *AntiEntropyEvent {
 	return &AntiEntropyEvent{
@@ -1005,6 +1694,17 @@ func (d *Detector) stateUpdate(node *InternalNode, state State, reincarnate bool
 		node.Incarnation.Witness(d.incarnation.Increment())
 	}
 
+	// replace the entry of the node in the view hash
+	entry := uint64(0)
+	if state != Dead {
+		entry = entryHash(node.Id, node.Incarnation.Get(), state)
+	}
+	atomic.StoreUint64(&d.viewHash, d.viewHash^node.viewEntry^entry)
+	node.viewEntry = entry
+
+	// publish the change to readers
+	d.publish(node)
+
 	// broadcast change in state
 	d.stateBroadcast(node)
 
@@ -1060,13 +1760,18 @@ func (d *Detector) SuspicionDuration() time.Duration {
 
 // Calculate the retransmission limit for broadcasts.
 func (d *Detector) RetransmitLimit() uint {
+	return d.retransmitLimit(d.RetransmitMult)
+}
+
+// Calculate the retransmission limit for the given multiplier.
+func (d *Detector) retransmitLimit(mult uint) uint {
 	// calculate the retransmission limit as mult*log(N+1); the division by three
 	n := uint(d.ActiveCount())
 	i := uint(log2ceil(int(n)+1) / 3)
 	if i < 1 {
 		i = 1
 	}
-	i = d.RetransmitMult * i
+	i = mult * i
 	if i > n {
 		return n
 	}
@@ -1,15 +1,159 @@
 package swim
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
 
+func TestDetectorUserEvents(t *testing.T) {
+	d := &Detector{
+		LocalNode:     Node{Id: 1},
+		ProbeInterval: 100 * time.Millisecond,
+		SuspicionMult: 3,
+		broker:        NewBroker(nil, nil),
+		userEvents:    make(map[userEventKey]time.Time),
+	}
+
+	// our own events are not re-broadcast
+	d.handleUserEvent(&UserEvent{From: 1, Incarnation: Seq(1)})
+	if n := d.broker.Broadcasts.Len(); n != 0 {
+		t.Fatalf("Expected own event to be ignored got %v broadcasts", n)
+	}
+
+	// new events are re-broadcast
+	event := &UserEvent{From: 2, Incarnation: Seq(1)}
+	d.handleUserEvent(event)
+	if l := d.broker.Broadcasts.List(); len(l) != 1 || l[0].Event != event {
+		t.Fatalf("Expected event to be re-broadcast got %v", l)
+	}
+
+	// seen events are not re-broadcast
+	d.broker.Broadcasts.Prune(func(b *Broadcast) bool { return true }, BroadcastDelivered)
+	d.handleUserEvent(&UserEvent{From: 2, Incarnation: Seq(1)})
+	if n := d.broker.Broadcasts.Len(); n != 0 {
+		t.Fatalf("Expected seen event to be ignored got %v broadcasts", n)
+	}
+
+	// events are forgotten after twice the suspicion duration
+	d.handleUserEvent(&UserEvent{From: 3, Incarnation: Seq(1)})
+	d.userEvents[userEventKey{2, Seq(1)}] = time.Now().Add(-2*d.SuspicionDuration() - time.Millisecond)
+	d.pruneUserEvents()
+	if _, ok := d.userEvents[userEventKey{2, Seq(1)}]; ok {
+		t.Fatalf("Expected old event to be forgotten")
+	} else if _, ok := d.userEvents[userEventKey{3, Seq(1)}]; !ok {
+		t.Fatalf("Expected recent event to be remembered")
+	}
+
+	// forgotten events are re-broadcast again
+	d.broker.Broadcasts.Prune(func(b *Broadcast) bool { return true }, BroadcastDelivered)
+	d.handleUserEvent(&UserEvent{From: 2, Incarnation: Seq(1)})
+	if n := d.broker.Broadcasts.Len(); n != 1 {
+		t.Fatalf("Expected forgotten event to be re-broadcast got %v broadcasts", n)
+	}
+
+	// events of different nodes with the same incarnation are both queued
+	d.broker.Broadcasts.Prune(func(b *Broadcast) bool { return true }, BroadcastDelivered)
+	d.handleUserEvent(&UserEvent{From: 4, Incarnation: Seq(7)})
+	d.handleUserEvent(&UserEvent{From: 5, Incarnation: Seq(7)})
+	if n := d.broker.Broadcasts.Len(); n != 2 {
+		t.Fatalf("Expected both events to be re-broadcast got %v broadcasts", n)
+	}
+}
+
+func TestDetectorTraceOrigin(t *testing.T) {
+	d := &Detector{
+		LocalNode:       Node{Id: 1},
+		ProbeInterval:   100 * time.Millisecond,
+		SuspicionMult:   3,
+		TraceBroadcasts: true,
+		broker:          NewBroker(nil, nil),
+		nodes:           new(ShuffleList),
+		nodeMap:         make(map[uint64]*InternalNode),
+		actives:         make(map[uint64]bool),
+		suspects:        make(map[uint64]*InternalNode),
+		userEvents:      make(map[userEventKey]time.Time),
+	}
+
+	// originated events are traced on a copy
+	event := &UserEvent{From: 1, Incarnation: Seq(1)}
+	d.Broadcast(event)
+	if event.Trace != nil {
+		t.Fatalf("Expected caller event to be unchanged got %v", event.Trace)
+	} else if l := d.broker.Broadcasts.List(); len(l) != 1 || traceOf(l[0].Event) == nil {
+		t.Fatalf("Expected traced broadcast got %v", l)
+	} else if trace := traceOf(l[0].Event); trace.Origin != 1 || trace.Hops != 0 {
+		t.Fatalf("Expected trace from origin got %v", trace)
+	}
+	d.broker.Broadcasts.Prune(func(b *Broadcast) bool { return true }, BroadcastDelivered)
+
+	// relayed user events without a trace are not traced
+	d.handleUserEvent(&UserEvent{From: 2, Incarnation: Seq(1)})
+	if l := d.broker.Broadcasts.List(); len(l) != 1 || traceOf(l[0].Event) != nil {
+		t.Fatalf("Expected untraced relay got %v", l)
+	}
+	d.broker.Broadcasts.Prune(func(b *Broadcast) bool { return true }, BroadcastDelivered)
+
+	// relayed state broadcasts without a trace are not traced
+	d.handleStateBroadcast(&AliveEvent{From: 2, Node: Node{Id: 2, Incarnation: Seq(1)}}, 2, Seq(1), Alive)
+	if l := d.broker.Broadcasts.List(); len(l) != 1 || traceOf(l[0].Event) != nil {
+		t.Fatalf("Expected untraced relay got %v", l)
+	}
+	d.broker.Broadcasts.Prune(func(b *Broadcast) bool { return true }, BroadcastDelivered)
+
+	// relayed traces are forwarded with another hop
+	trace := &Trace{Origin: 3, Hops: 1}
+	d.handleStateBroadcast(&SuspectEvent{From: 3, Id: 2, Incarnation: Seq(2), Trace: trace}, 2, Seq(2), Suspect)
+	if l := d.broker.Broadcasts.List(); len(l) != 1 || traceOf(l[0].Event) == nil {
+		t.Fatalf("Expected traced relay got %v", l)
+	} else if next := traceOf(l[0].Event); next.Origin != 3 || next.Hops != 2 {
+		t.Fatalf("Expected forwarded trace got %v", next)
+	}
+}
+
+func TestDetectorTraceReceipt(t *testing.T) {
+	d := &Detector{
+		LocalNode:     Node{Id: 1},
+		ProbeInterval: 100 * time.Millisecond,
+		SuspicionMult: 3,
+		TraceCh:       make(chan BroadcastTrace),
+		broker:        NewBroker(nil, nil),
+		userEvents:    make(map[userEventKey]time.Time),
+	}
+
+	msg := &Message{From: 2}
+	msg.AddEvent(&UserEvent{From: 2, Incarnation: Seq(1), Trace: &Trace{Origin: 2}})
+	handled := make(chan struct{})
+	go func() {
+		d.handle(msg)
+		close(handled)
+	}()
+
+	// the receipt is sent after the lock is released
+	var record BroadcastTrace
+	select {
+	case record = <-d.TraceCh:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a trace record")
+	}
+	d.l.Lock()
+	d.l.Unlock()
+	<-handled
+
+	// the recorded event is as received
+	if record.Origin != 2 || record.Hops != 1 {
+		t.Fatalf("Expected one hop from node 2 got %v", record)
+	} else if e := record.Event.(*UserEvent); e.Trace.Hops != 0 {
+		t.Fatalf("Expected received trace got %v", e.Trace)
+	}
+}
+
 func TestDetector(t *testing.T) {
 
 	router := NewSimRouter()
@@ -176,3 +320,525 @@ RETRY_LEAVE:
 		t.Fatalf("N1 should report two active nodes got %v", n)
 	}
 }
+
+func TestDetectorBroadcastSync(t *testing.T) {
+	d := newTestDetector(NewSimRouter(), 1)
+	d.ProbeInterval = 100 * time.Millisecond
+	d.ProbeTimeout = 30 * time.Millisecond
+	d.Start()
+
+	// time out without peers
+	event := &UserEvent{From: 1, Incarnation: Seq(1), Data: "hello"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.BroadcastSyncContext(ctx, event); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded got %v", err)
+	}
+
+	// release on stop
+	done := d.broker.BroadcastSync(&UserEvent{From: 1, Incarnation: Seq(2)})
+	d.Stop()
+	select {
+	case result := <-done:
+		if result.Reason != BroadcastStopped {
+			t.Fatalf("Expected stopped got %v", result.Reason)
+		} else if result.Nodes != 0 {
+			t.Fatalf("Expected 0 nodes got %v", result.Nodes)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected broadcast to be released on stop")
+	}
+
+	// release immediately once stopped
+	results := make(chan BroadcastResult, 1)
+	go func() {
+		results <- d.BroadcastSync(&UserEvent{From: 1, Incarnation: Seq(3)})
+	}()
+	select {
+	case result := <-results:
+		if result.Reason != BroadcastStopped {
+			t.Fatalf("Expected stopped got %v", result.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected broadcast to be released when stopped")
+	}
+}
+
+func TestDetectorGossip(t *testing.T) {
+	router := NewSimRouter()
+	d1, d2 := newTestDetector(router, 1), newTestDetector(router, 2)
+
+	// no probes, so broadcasts are only sent by gossip
+	for _, d := range []*Detector{d1, d2} {
+		d.ProbeInterval = time.Second
+		d.ProbeTimeout = 300 * time.Millisecond
+		d.GossipInterval = 50 * time.Millisecond
+		d.GossipNodes = 1
+		d.MessageCh = make(chan Message, 1)
+	}
+	d1.Join(d2.LocalNode.Addrs...)
+	d2.Join(d1.LocalNode.Addrs...)
+	defer d1.Stop()
+	defer d2.Stop()
+
+	// drain the join messages until the test ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-d1.MessageCh:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	d1.Broadcast(&UserEvent{From: 1, Incarnation: Seq(1), Data: "gossip"})
+	for timeout := time.After(2 * time.Second); ; {
+		select {
+		case msg := <-d2.MessageCh:
+			for _, event := range msg.Events() {
+				if _, ok := event.(UserEvent); ok {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatalf("Expected broadcast to be gossiped")
+		}
+	}
+}
+
+func TestDetectorDigest(t *testing.T) {
+	router := NewSimRouter()
+	d1, d2 := newTestDetector(router, 1), newTestDetector(router, 2)
+	for _, d := range []*Detector{d1, d2} {
+		d.DirectProbes = 1
+		d.ProbeInterval = 50 * time.Millisecond
+		d.ProbeTimeout = 10 * time.Millisecond
+		d.DigestInterval = 50 * time.Millisecond
+		d.UpdateCh = make(chan Node, 1)
+	}
+	d1.Join(d2.LocalNode.Addrs...)
+	d2.Join(d1.LocalNode.Addrs...)
+	defer d1.Stop()
+	defer d2.Stop()
+
+	// drain the updates until the test ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-d1.UpdateCh:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// wait for node 2 to learn of node 1
+	for timeout := time.After(2 * time.Second); ; {
+		select {
+		case node := <-d2.UpdateCh:
+			if node.Id != 1 {
+				continue
+			}
+		case <-timeout:
+			t.Fatalf("Expected node 2 to learn of node 1")
+		}
+		break
+	}
+
+	// node 1 learns of node 3 without broadcasting or probing it
+	d1.l.Lock()
+	node3 := d1.lookup(3, []string{"node 3"})
+	node3.Incarnation = Seq(5)
+	node3.State = Alive
+	d1.actives[3] = true
+	d1.l.Unlock()
+
+	// node 2 repairs its view from the digest
+	for timeout := time.After(2 * time.Second); ; {
+		select {
+		case node := <-d2.UpdateCh:
+			if node.Id == 3 && node.State == Alive && node.Incarnation == Seq(5) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected node 2 to repair node 3")
+		}
+	}
+}
+
+func TestDetectorCoordinates(t *testing.T) {
+	router := NewSimRouter()
+	d1, d2 := newTestDetector(router, 1), newTestDetector(router, 2)
+	for _, d := range []*Detector{d1, d2} {
+		d.DirectProbes = 1
+		d.ProbeTimeout = 150 * time.Millisecond
+		d.Coordinates = true
+	}
+	d1.Join(d2.LocalNode.Addrs...)
+	d2.Join(d1.LocalNode.Addrs...)
+	defer d1.Stop()
+	defer d2.Stop()
+
+	if _, ok := d1.EstimateRTT(1, 3); ok {
+		t.Fatalf("Expected no estimate for unknown node")
+	}
+
+	// wait for the coordinates to be exchanged and updated
+	for timeout := time.After(3 * time.Second); ; {
+		_, ok := d1.EstimateRTT(2, 1)
+		if c := d1.Coordinate(); ok && c.Vec[0] != 0 {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("Expected an RTT estimate from updated coordinates")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestDetectorViewHash(t *testing.T) {
+
+	node := func(id uint64) *Detector {
+		d := &Detector{LocalNode: Node{Id: id, Incarnation: Seq(id), State: Alive}}
+		d.broker = NewBroker(newTestTransport(512), newMockCodec())
+		d.nodes = &ShuffleList{}
+		d.nodeMap = make(map[uint64]*InternalNode)
+		d.actives = make(map[uint64]bool)
+		d.suspects = make(map[uint64]*InternalNode)
+		return d
+	}
+
+	update := func(d *Detector, id uint64, state State) {
+		node := d.lookup(id, nil)
+		node.Incarnation = Seq(id)
+		d.stateUpdate(node, state, false)
+	}
+
+	// views of the same members agree
+	d1, d2 := node(1), node(2)
+	update(d1, 2, Alive)
+	update(d1, 3, Alive)
+	update(d2, 3, Alive)
+	update(d2, 1, Alive)
+	if d1.ViewHash() != d2.ViewHash() {
+		t.Fatalf("Expected the same view hash")
+	}
+
+	// states differ
+	update(d2, 3, Suspect)
+	if d1.ViewHash() == d2.ViewHash() {
+		t.Fatalf("Expected different view hashes")
+	}
+
+	// dead nodes are not part of the view
+	update(d1, 3, Dead)
+	update(d2, 3, Dead)
+	if d1.ViewHash() != d2.ViewHash() {
+		t.Fatalf("Expected the same view hash")
+	}
+
+	// acknowledged views
+	d1.nodeMap[2].RemoteViewHash = d2.ViewHash()
+	if ids := d1.DivergentNodes(); len(ids) != 0 {
+		t.Fatalf("Expected no divergent nodes got %v", ids)
+	}
+	d1.LocalNode.Incarnation = Seq(4)
+	if ids := d1.DivergentNodes(); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("Expected node 2 to diverge got %v", ids)
+	}
+
+	// the view hash agrees with the digest in any local state
+	for _, state := range []State{Alive, Suspect, Dead} {
+		d1.LocalNode.State = state
+		hash := uint64(0)
+		for _, bucket := range d1.digest(kDigestBuckets) {
+			hash ^= bucket
+		}
+		if hash != d1.ViewHash() {
+			t.Fatalf("Expected view hash %v in state %v got %v", hash, state, d1.ViewHash())
+		}
+	}
+}
+
+func TestDetectorMembership(t *testing.T) {
+	d := &Detector{LocalNode: Node{Id: 1, State: Alive}}
+	d.broker = NewBroker(newTestTransport(512), newMockCodec())
+	d.nodes = &ShuffleList{}
+	d.nodeMap = make(map[uint64]*InternalNode)
+	d.actives = make(map[uint64]bool)
+	d.suspects = make(map[uint64]*InternalNode)
+
+	if _, ok := d.Member(1); ok {
+		t.Fatalf("Expected an empty snapshot")
+	}
+
+	d.stateUpdate(d.lookup(2, nil), Alive, false)
+	d.stateUpdate(d.lookup(3, nil), Suspect, false)
+	snapshot := d.Snapshot()
+	d.stateUpdate(d.lookup(2, nil), Dead, false)
+
+	if node, ok := d.Member(1); !ok || node.Id != 1 {
+		t.Fatalf("Expected the local node got %v", node)
+	} else if node, ok := d.Member(2); !ok || node.State != Dead {
+		t.Fatalf("Expected node 2 to be dead got %v", node)
+	} else if node, ok := snapshot.Member(2); !ok || node.State != Alive {
+		t.Fatalf("Expected node 2 to be alive in the snapshot got %v", node)
+	}
+	if nodes := d.MembersByState(Suspect); len(nodes) != 1 || nodes[0].Id != 3 {
+		t.Fatalf("Expected node 3 to be suspect got %v", nodes)
+	}
+	if nodes := d.MembersWhere(func(node *Node) bool { return node.Id > 1 }); len(nodes) != 2 {
+		t.Fatalf("Expected 2 nodes got %v", nodes)
+	}
+
+	// catch up from the earlier snapshot
+	changes, version, err := d.ChangesSince(snapshot.Version)
+	if err != nil {
+		t.Fatal(err)
+	} else if version != d.Snapshot().Version {
+		t.Fatalf("Expected version %v got %v", d.Snapshot().Version, version)
+	} else if len(changes) != 1 || changes[0].Node.Id != 2 || changes[0].Node.State != Dead {
+		t.Fatalf("Expected the death of node 2 got %v", changes)
+	}
+	if v, err := d.WaitForChange(context.Background(), snapshot.Version); err != nil || v != version {
+		t.Fatalf("Expected version %v got %v %v", version, v, err)
+	}
+}
+
+func TestDetectorUpdateLocalNode(t *testing.T) {
+	router := NewSimRouter()
+	d1, d2 := newTestDetector(router, 1), newTestDetector(router, 2)
+	for _, d := range []*Detector{d1, d2} {
+		d.LocalNode.UserData = "v1"
+		d.DirectProbes = 1
+		d.IndirectProbes = 1
+	}
+
+	// not yet started
+	d1.SetUserData("v2")
+	if d1.LocalNode.UserData != "v2" || d1.LocalNode.Incarnation != 0 {
+		t.Fatalf("Expected user data v2 at incarnation 0 got %v", d1.LocalNode)
+	}
+
+	d1.Join(d2.LocalNode.Addrs...)
+	d2.Join(d1.LocalNode.Addrs...)
+
+	// only the addresses and user data change
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	incarnation := d1.Snapshot().LocalNode.Incarnation
+	_, err := d1.UpdateLocalNodeSync(ctx, func(node *Node) {
+		node.Id = 3
+		node.UserData = "v3"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local := d1.Snapshot().LocalNode; local.Id != 1 || local.UserData != "v3" {
+		t.Fatalf("Expected node 1 with user data v3 got %v", local)
+	} else if local.Incarnation.Compare(incarnation) <= 0 {
+		t.Fatalf("Expected incarnation after %v got %v", incarnation, local.Incarnation)
+	}
+
+	// the update propagated
+	for timeout := time.After(2 * time.Second); ; {
+		if node, ok := d2.Member(1); ok && node.UserData == "v3" {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("Expected node 2 to learn of the update")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// stopped and departed detectors apply the update without broadcasting
+	d1.Stop()
+	d2.Leave()
+	for _, d := range []*Detector{d1, d2} {
+		incarnation := d.LocalNode.Incarnation
+		queued := d.broker.Broadcasts.Len()
+		result, err := d.UpdateLocalNodeSync(ctx, func(node *Node) {
+			node.UserData = "v4"
+		})
+		if err != nil || result != (BroadcastResult{}) {
+			t.Fatalf("Expected no broadcast got %v %v", result, err)
+		} else if d.LocalNode.UserData != "v4" || d.LocalNode.Incarnation != incarnation {
+			t.Fatalf("Expected user data v4 at incarnation %v got %v", incarnation, d.LocalNode)
+		} else if n := d.broker.Broadcasts.Len(); n != queued {
+			t.Fatalf("Expected %v queued broadcasts got %v", queued, n)
+		}
+	}
+}
+
+type testPingDelegate struct {
+	payload []byte
+	pings   chan testPing
+	l       *sync.Mutex // Lock to check when notified, if not nil
+}
+
+type testPing struct {
+	node    Node
+	rtt     time.Duration
+	payload []byte
+	locked  bool
+}
+
+func (p *testPingDelegate) AckPayload() []byte {
+	return p.payload
+}
+
+func (p *testPingDelegate) NotifyPingComplete(node *Node, rtt time.Duration, payload []byte) {
+	locked := false
+	if p.l != nil {
+		if locked = !p.l.TryLock(); !locked {
+			p.l.Unlock()
+		}
+	}
+	select {
+	case p.pings <- testPing{*node, rtt, payload, locked}:
+	default:
+	}
+}
+
+func TestDetectorPingDelegate(t *testing.T) {
+	router := NewSimRouter()
+	d1, d2 := newTestDetector(router, 1), newTestDetector(router, 2)
+	p1 := &testPingDelegate{payload: []byte("load 1"), pings: make(chan testPing, 16)}
+	p2 := &testPingDelegate{payload: []byte("load 2"), pings: make(chan testPing, 16)}
+	d1.PingDelegate, d2.PingDelegate = p1, p2
+	for _, d := range []*Detector{d1, d2} {
+		d.DirectProbes = 1
+		d.IndirectProbes = 1
+	}
+	d1.Join(d2.LocalNode.Addrs...)
+	d2.Join(d1.LocalNode.Addrs...)
+	defer d1.Stop()
+	defer d2.Stop()
+
+	// each node receives the payload of the other with the ack
+	check := func(pings chan testPing, id uint64, payload string) {
+		select {
+		case ping := <-pings:
+			if ping.node.Id != id {
+				t.Fatalf("Expected ack from node %v got %v", id, ping.node)
+			} else if string(ping.payload) != payload {
+				t.Fatalf("Expected payload %q got %q", payload, ping.payload)
+			} else if ping.rtt <= 0 {
+				t.Fatalf("Expected positive RTT got %v", ping.rtt)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Expected ack from node %v", id)
+		}
+	}
+	check(p1.pings, 2, "load 2")
+	check(p2.pings, 1, "load 1")
+}
+
+func TestDetectorPingDelegateAcks(t *testing.T) {
+	p := &testPingDelegate{pings: make(chan testPing, 16)}
+	d := &Detector{
+		LocalNode:     Node{Id: 1},
+		ProbeInterval: 100 * time.Millisecond,
+		SuspicionMult: 3,
+		PingDelegate:  p,
+		broker:        NewBroker(nil, nil),
+		nodes:         new(ShuffleList),
+		nodeMap:       make(map[uint64]*InternalNode),
+		actives:       make(map[uint64]bool),
+		suspects:      make(map[uint64]*InternalNode),
+	}
+	p.l = &d.l
+
+	// acks relayed for another node are not for pings of this node
+	msg := &Message{From: 3}
+	msg.AddEvent(IndirectAckEvent{
+		AckEvent: AckEvent{From: 3, Time: time.Now(), Payload: []byte("relayed")},
+		Via:      2,
+		ViaTime:  time.Now(),
+	})
+	d.handle(msg)
+	select {
+	case ping := <-p.pings:
+		t.Fatalf("Expected no notification got %v", ping)
+	default:
+	}
+
+	// acks to pings of this node are notified after the lock is released
+	msg = &Message{From: 4}
+	msg.AddEvent(AckEvent{From: 4, Time: time.Now(), Payload: []byte("direct")})
+	d.handle(msg)
+	select {
+	case ping := <-p.pings:
+		if ping.node.Id != 4 || string(ping.payload) != "direct" {
+			t.Fatalf("Expected ack from node 4 got %v", ping)
+		} else if ping.locked {
+			t.Fatalf("Expected notification after the lock is released")
+		}
+	default:
+		t.Fatalf("Expected a notification")
+	}
+}
+
+func TestDetectorDirectProbes(t *testing.T) {
+	d := &Detector{DirectProbes: 1, MaxDirectProbes: 4}
+	d.broker = NewBroker(newTestTransport(512), newMockCodec())
+	d.broker.bEstimate = 3.0
+
+	queue := func(n int) {
+		for i := 0; i < n; i += 1 {
+			d.broker.Broadcast(&DeathEvent{From: 1, Id: uint64(d.broker.Pending() + 10), Incarnation: Seq(1)})
+		}
+	}
+
+	// steady state
+	if p := d.directProbes(); p != 1 {
+		t.Fatalf("Expected 1 probe got %v", p)
+	}
+
+	// small backlog fits in one message
+	queue(3)
+	if p := d.directProbes(); p != 1 {
+		t.Fatalf("Expected 1 probe got %v", p)
+	}
+
+	// scale with the backlog
+	queue(4)
+	if p := d.directProbes(); p != 3 {
+		t.Fatalf("Expected 3 probes got %v", p)
+	}
+
+	// bounded by the maximum
+	queue(20)
+	if p := d.directProbes(); p != 4 {
+		t.Fatalf("Expected 4 probes got %v", p)
+	}
+
+	// not adaptive
+	d.MaxDirectProbes = 0
+	if p := d.directProbes(); p != 1 {
+		t.Fatalf("Expected 1 probe got %v", p)
+	}
+}
+
+func newTestDetector(router *SimRouter, id uint64) *Detector {
+	name := fmt.Sprintf("node %v", id)
+	return &Detector{
+		LocalNode: Node{
+			Id:    id,
+			Addrs: []string{name},
+		},
+		ProbeInterval:  300 * time.Millisecond,
+		ProbeTimeout:   100 * time.Millisecond,
+		RetransmitMult: 3,
+		SuspicionMult:  3,
+		Transport:      router.NewTransport(name),
+		Codec:          new(GobCodec),
+	}
+}
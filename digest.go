@@ -0,0 +1,56 @@
+package swim
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+const kDigestBuckets = 16
+
+// A digest summarizes a membership view as buckets of hashed node entries.
+// Each bucket is the XOR of the hashes of the (id, incarnation, state)
+// entries of the nodes in the bucket, so that two nodes can find the parts
+// of their views that differ by exchanging one hash per bucket instead of
+// their full views.
+type Digest []uint64
+
+// Create an empty digest with the given number of buckets.
+func NewDigest(buckets int) Digest {
+	return make(Digest, buckets)
+}
+
+// Get the bucket for the node ID.
+func (d Digest) Bucket(id uint64) int {
+	return int(id % uint64(len(d)))
+}
+
+// Add a node entry to the digest. Adding the same entry again removes it.
+func (d Digest) Add(id uint64, incarnation Seq, state State) {
+	d[d.Bucket(id)] ^= entryHash(id, incarnation, state)
+}
+
+// Get the buckets that differ between the digests. Digests with different
+// numbers of buckets can't be compared and have no differing buckets.
+func (d Digest) Diff(that Digest) (buckets []uint) {
+	if len(d) != len(that) {
+		return nil
+	}
+	for i := range d {
+		if d[i] != that[i] {
+			buckets = append(buckets, uint(i))
+		}
+	}
+	return
+}
+
+// Hash the (id, incarnation, state) entry of a node.
+func entryHash(id uint64, incarnation Seq, state State) uint64 {
+	var buf [13]byte
+	binary.BigEndian.PutUint64(buf[0:], id)
+	binary.BigEndian.PutUint32(buf[8:], uint32(incarnation))
+	buf[12] = byte(state)
+
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
@@ -0,0 +1,44 @@
+package swim
+
+import (
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	a, b := NewDigest(4), NewDigest(4)
+	a.Add(1, Seq(2), Alive)
+	a.Add(6, Seq(3), Suspect)
+	b.Add(6, Seq(3), Suspect)
+	b.Add(1, Seq(2), Alive)
+
+	// same entries in any order
+	if buckets := a.Diff(b); len(buckets) != 0 {
+		t.Fatalf("Expected no differences got %v", buckets)
+	}
+
+	// differing incarnation
+	b.Add(1, Seq(2), Alive)
+	b.Add(1, Seq(3), Alive)
+	if buckets := a.Diff(b); len(buckets) != 1 || buckets[0] != 1 {
+		t.Fatalf("Expected bucket 1 to differ got %v", buckets)
+	}
+
+	// differing state
+	b.Add(6, Seq(3), Suspect)
+	b.Add(6, Seq(3), Alive)
+	if buckets := a.Diff(b); len(buckets) != 2 || buckets[1] != 2 {
+		t.Fatalf("Expected buckets 1 and 2 to differ got %v", buckets)
+	}
+
+	// adding twice removes the entry
+	a.Add(1, Seq(2), Alive)
+	a.Add(6, Seq(3), Suspect)
+	if buckets := a.Diff(NewDigest(4)); len(buckets) != 0 {
+		t.Fatalf("Expected empty digest got %v", a)
+	}
+
+	// incomparable
+	if buckets := a.Diff(NewDigest(8)); buckets != nil {
+		t.Fatalf("Expected no differences got %v", buckets)
+	}
+}
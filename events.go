@@ -21,15 +21,20 @@ func (e PingEvent) String() string {
 // An ack event acknowledges a ping. The returned timestamp is used to
 // determine which ping the remote node is responding to and to measure the
 // round-trip time. The last known incarnation number of the requesting node
-// is returned by the responding node for anti-entropy.
+// is returned by the responding node for anti-entropy. The responding node
+// may include the hash of its membership view.
 type AckEvent struct {
-	From uint64    // ID of requesting node
-	Time time.Time // Local time at ping node
+	From     uint64    // ID of requesting node
+	Time     time.Time // Local time at ping node
+	ViewHash uint64    // View hash of the responding node, or 0 if not sent
+	Payload  []byte    // Application payload from the PingDelegate, if any
 }
 
 // Default format output.
 func (e AckEvent) String() string {
-	return fmt.Sprintf("AckEvent{ From: %v, Time: %v }", e.From, e.Time)
+	return fmt.Sprintf(
+		"AckEvent{ From: %v, Time: %v, ViewHash: %v, Payload: %v }",
+		e.From, e.Time, e.ViewHash, e.Payload)
 }
 
 // An indirect ping request asks an unrelated node to probe the target node.
@@ -92,10 +97,56 @@ func (e AntiEntropyEvent) String() string {
 	return fmt.Sprintf("AntiEntropyEvent{ %v }", e.Node)
 }
 
+// A coordinate event carries the network coordinate of the sending node
+// with a ping or an ack, if coordinates are enabled. With an ack, the event
+// returns the timestamp of the ping, so that the requesting node can sample
+// the round-trip time to the responding node.
+type CoordinateEvent struct {
+	From  uint64     // ID of the sending node
+	Time  time.Time  // Local time at ping node, or zero with a ping
+	Coord Coordinate // Network coordinate of the sending node
+}
+
+// Default format output.
+func (e CoordinateEvent) String() string {
+	return fmt.Sprintf(
+		"CoordinateEvent{ From: %v, Time: %v, Coord: %v }",
+		e.From, e.Time, e.Coord)
+}
+
+// A digest event summarizes the membership view of the sending node. The
+// receiving node requests the entries in the buckets that differ from its
+// own view.
+type DigestEvent struct {
+	From   uint64 // ID of the sending node
+	Digest Digest // Digest of the sending node's view
+}
+
+// Default format output.
+func (e DigestEvent) String() string {
+	return fmt.Sprintf("DigestEvent{ From: %v, Digest: %v }", e.From, e.Digest)
+}
+
+// A digest request event asks the receiving node to send its entries in
+// the given digest buckets.
+type DigestRequestEvent struct {
+	From    uint64 // ID of the requesting node
+	Buckets []uint // Digest buckets that differ
+	Size    int    // Number of buckets in the digest
+}
+
+// Default format output.
+func (e DigestRequestEvent) String() string {
+	return fmt.Sprintf(
+		"DigestRequestEvent{ From: %v, Buckets: %v, Size: %v }",
+		e.From, e.Buckets, e.Size)
+}
+
 // Broadcast tags are used to efficiently invalidate existing broadcasts.
 type BroadcastTag struct {
 	Id      uint64
 	IsState bool
+	From    uint64 // Source of a user event, as user events of different nodes are unrelated
 }
 
 // A broadcast event exposes the sequence and tag methods.
@@ -108,8 +159,9 @@ type BroadcastEvent interface {
 // An alive event indicates that a node is alive, joining the group, or
 // that its metadata (addresses and/or user data) has changed.
 type AliveEvent struct {
-	From uint64 // ID of the node broadcasting this event
-	Node        // The alive node
+	From  uint64 // ID of the node broadcasting this event
+	Node         // The alive node
+	Trace *Trace // Propagation metadata, if traced
 }
 
 // Default format output.
@@ -124,7 +176,7 @@ func (e AliveEvent) Source() uint64 {
 
 // Get the tag for the alive event.
 func (e AliveEvent) Tag() BroadcastTag {
-	return BroadcastTag{e.Id, true}
+	return BroadcastTag{Id: e.Id, IsState: true}
 }
 
 // Get the sequence for the alive event.
@@ -137,6 +189,7 @@ type SuspectEvent struct {
 	From        uint64 // ID of the node broadcasting this event
 	Id          uint64 // ID of the suspected node
 	Incarnation Seq    // Incarnation number of the node
+	Trace       *Trace // Propagation metadata, if traced
 }
 
 // Default format output.
@@ -153,7 +206,7 @@ func (e SuspectEvent) Source() uint64 {
 
 // Get the tag for the suspect event.
 func (e SuspectEvent) Tag() BroadcastTag {
-	return BroadcastTag{e.Id, true}
+	return BroadcastTag{Id: e.Id, IsState: true}
 }
 
 // Get the sequence for the suspect event.
@@ -166,6 +219,7 @@ type DeathEvent struct {
 	From        uint64 // ID of the node broadcasting this event
 	Id          uint64 // ID of the dead node
 	Incarnation Seq    // Incarnation number of the node
+	Trace       *Trace // Propagation metadata, if traced
 }
 
 // Default format output.
@@ -182,7 +236,7 @@ func (e DeathEvent) Source() uint64 {
 
 // Get the tag for the death event.
 func (e DeathEvent) Tag() BroadcastTag {
-	return BroadcastTag{e.Id, true}
+	return BroadcastTag{Id: e.Id, IsState: true}
 }
 
 // Get the sequence for the death event.
@@ -196,6 +250,7 @@ type UserEvent struct {
 	From        uint64      // ID of the node broadcasting this event
 	Incarnation Seq         // Incarnation number of the event
 	Data        interface{} // User-specific data associated with the node
+	Trace       *Trace      // Propagation metadata, if traced
 }
 
 // Default format output.
@@ -212,7 +267,7 @@ func (e UserEvent) Source() uint64 {
 
 // Get the tag for the user event.
 func (e UserEvent) Tag() BroadcastTag {
-	return BroadcastTag{uint64(e.Incarnation), false}
+	return BroadcastTag{Id: uint64(e.Incarnation), From: e.From}
 }
 
 // Get the sequence for the user event.
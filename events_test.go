@@ -16,11 +16,12 @@ func TestBroadcastEvent(t *testing.T) {
 	}
 
 	tag := BroadcastTag{Id: 34, IsState: true}
-	isBroadcast(&AliveEvent{12, Node{Id: 34, Incarnation: 13}}, tag)
-	isBroadcast(&SuspectEvent{12, 34, 13}, tag)
-	isBroadcast(&DeathEvent{12, 34, 13}, tag)
+	isBroadcast(&AliveEvent{12, Node{Id: 34, Incarnation: 13}, nil}, tag)
+	isBroadcast(&SuspectEvent{12, 34, 13, nil}, tag)
+	isBroadcast(&DeathEvent{12, 34, 13, nil}, tag)
 
 	tag.Id = 13
 	tag.IsState = false
-	isBroadcast(&UserEvent{34, 13, nil}, tag)
+	tag.From = 34
+	isBroadcast(&UserEvent{34, 13, nil, nil}, tag)
 }
@@ -62,3 +62,15 @@ func (c *FlateCodec) Encode(coded *CodedMessage) error {
 
 	return nil
 }
+
+// Implementation of SizingCodec.NewSizer()
+func (c *FlateCodec) NewSizer(message *Message) (Sizer, error) {
+	return newEventSizer(c.Codec, message, flateBound)
+}
+
+// Bound the size of n bytes after compression. DEFLATE falls back to stored
+// blocks of up to 65535 bytes with five bytes of header each, and the
+// writer ends the stream with an empty stored block.
+func flateBound(n int) int {
+	return n + 5*(n/65535+2)
+}
@@ -7,3 +7,7 @@ import (
 func TestFlateCodec(t *testing.T) {
 	testCodec(t, &FlateCodec{new(GobCodec)})
 }
+
+func TestFlateCodecSizer(t *testing.T) {
+	testSizer(t, &FlateCodec{new(GobCodec)}, -1)
+}
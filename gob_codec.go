@@ -44,6 +44,11 @@ func (c *GobCodec) Encode(coded *CodedMessage) error {
 	return nil
 }
 
+// Implementation of SizingCodec.NewSizer()
+func (c *GobCodec) NewSizer(message *Message) (Sizer, error) {
+	return newEventSizer(c, message, nil)
+}
+
 // Register interface{} values.
 func init() {
 	gob.Register(PingEvent{})
@@ -52,6 +57,9 @@ func init() {
 	gob.Register(IndirectPingEvent{})
 	gob.Register(IndirectAckEvent{})
 	gob.Register(AntiEntropyEvent{})
+	gob.Register(CoordinateEvent{})
+	gob.Register(DigestEvent{})
+	gob.Register(DigestRequestEvent{})
 	gob.Register(AliveEvent{})
 	gob.Register(SuspectEvent{})
 	gob.Register(DeathEvent{})
@@ -8,3 +8,7 @@ func TestGobCodec(t *testing.T) {
 	var codec GobCodec
 	testCodec(t, &codec)
 }
+
+func TestGobCodecSizer(t *testing.T) {
+	testSizer(t, new(GobCodec), kSizerSlack)
+}
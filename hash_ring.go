@@ -0,0 +1,230 @@
+package swim
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+)
+
+const kHashRingVirtualNodes = 128
+
+// A weighted user data sets the weight of a node in the membership hashes.
+type Weighted interface {
+	Weight() float64
+}
+
+// A hash ring maps keys to member nodes by consistent hashing. Each node is
+// placed at a number of points on the ring, its virtual nodes, in proportion
+// to its weight, and a key maps to the nodes of the first points at or after
+// the hash of the key. When a node joins or dies, only the keys mapping to
+// its points move, so that the other keys keep their nodes.
+//
+// The ring is driven by the membership updates of a detector: apply each
+// update with Update, or watch the UpdateCh of the detector with Watch. The
+// local node, which the detector does not send, must be added with Update.
+// The methods are safe to run concurrently, but the parameters must not
+// change after the first update.
+type HashRing struct {
+	Replicas     int                      // Number of distinct nodes per key, or 1 if zero
+	VirtualNodes int                      // Number of virtual nodes per unit of weight, or 128 if zero
+	Weight       func(node *Node) float64 // Weight of each node, or the UserDataWeight if nil
+	UpdateCh     chan Node                // If not nil, channel on which to forward watched updates
+
+	l       sync.RWMutex
+	members map[uint64]hashMember // Members by ID
+	points  []ringPoint           // Points sorted by hash
+}
+
+// A member of a membership hash.
+type hashMember struct {
+	node   Node
+	weight float64
+}
+
+// A virtual node on the hash ring.
+type ringPoint struct {
+	hash uint64
+	id   uint64
+}
+
+// Get the weight of a node from its user data, if it implements Weighted,
+// or 1 otherwise.
+func UserDataWeight(node *Node) float64 {
+	if w, ok := node.UserData.(Weighted); ok {
+		return w.Weight()
+	}
+	return 1
+}
+
+// Apply a membership update: add or update the node, or remove it if dead.
+func (r *HashRing) Update(node Node) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.members == nil {
+		r.members = make(map[uint64]hashMember)
+	}
+
+	// the points only change with the weight
+	weight := 0.0
+	if node.State != Dead {
+		weight = nodeWeight(r.Weight, &node)
+	}
+	that, ok := r.members[node.Id]
+	if ok && that.weight == weight && node.State != Dead {
+		r.members[node.Id] = hashMember{node, weight}
+		return
+	}
+
+	// remove the points of the node
+	if ok {
+		points := r.points[:0]
+		for _, p := range r.points {
+			if p.id != node.Id {
+				points = append(points, p)
+			}
+		}
+		r.points = points
+		delete(r.members, node.Id)
+	}
+	if node.State == Dead {
+		return
+	}
+	r.members[node.Id] = hashMember{node, weight}
+
+	// merge the new points into the ring
+	adds := make([]ringPoint, r.virtualNodes(weight))
+	for i := range adds {
+		adds[i] = ringPoint{hash: pointHash(node.Id, uint64(i)), id: node.Id}
+	}
+	sort.Slice(adds, func(i, j int) bool { return adds[i].less(adds[j]) })
+	r.points = mergePoints(r.points, adds)
+}
+
+// Apply the updates received on the channel, such as the UpdateCh of a
+// detector, until the channel is closed, forwarding each update to the
+// UpdateCh of the ring if not nil.
+func (r *HashRing) Watch(updates <-chan Node) {
+	for node := range updates {
+		r.Update(node)
+		if r.UpdateCh != nil {
+			r.UpdateCh <- node
+		}
+	}
+}
+
+// Get the nodes for the key, in order of preference: the nodes of the first
+// Replicas distinct points at or after the hash of the key.
+func (r *HashRing) Lookup(key []byte) []Node {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	n := replicas(r.Replicas, len(r.members))
+	if n == 0 || len(r.points) == 0 {
+		return nil
+	}
+
+	// find the first point at or after the key
+	h := keyHash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	// walk the ring for distinct nodes
+	nodes := make([]Node, 0, n)
+	seen := make(map[uint64]bool, n)
+	for j := 0; j < len(r.points) && len(nodes) < n; j += 1 {
+		p := r.points[(i+j)%len(r.points)]
+		if !seen[p.id] {
+			seen[p.id] = true
+			nodes = append(nodes, r.members[p.id].node)
+		}
+	}
+	return nodes
+}
+
+// Get the number of member nodes.
+func (r *HashRing) Len() int {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	return len(r.members)
+}
+
+// Get the number of virtual nodes for the weight.
+func (r *HashRing) virtualNodes(weight float64) int {
+	vnodes := r.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = kHashRingVirtualNodes
+	}
+	if weight <= 0 {
+		return 0
+	} else if n := int(math.Round(float64(vnodes) * weight)); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// Determine if the point comes before that point on the ring.
+func (p ringPoint) less(that ringPoint) bool {
+	if p.hash != that.hash {
+		return p.hash < that.hash
+	}
+	return p.id < that.id
+}
+
+// Merge two sorted lists of points.
+func mergePoints(a, b []ringPoint) []ringPoint {
+	points := make([]ringPoint, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].less(a[0]) {
+			points = append(points, b[0])
+			b = b[1:]
+		} else {
+			points = append(points, a[0])
+			a = a[1:]
+		}
+	}
+	points = append(points, a...)
+	return append(points, b...)
+}
+
+// Get the weight of the node using the weight function, or the
+// UserDataWeight if nil.
+func nodeWeight(weight func(node *Node) float64, node *Node) float64 {
+	if weight == nil {
+		return UserDataWeight(node)
+	}
+	return weight(node)
+}
+
+// Get the number of nodes to return from a lookup.
+func replicas(replicas, members int) int {
+	if replicas <= 0 {
+		replicas = 1
+	}
+	if replicas > members {
+		return members
+	}
+	return replicas
+}
+
+// Hash a key.
+func keyHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return mix64(h.Sum64())
+}
+
+// Hash a pair of a node ID and a value, such as a virtual node index or the
+// hash of a key.
+func pointHash(id, x uint64) uint64 {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[0:], id)
+	binary.BigEndian.PutUint64(buf[8:], x)
+
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return mix64(h.Sum64())
+}
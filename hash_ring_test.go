@@ -0,0 +1,160 @@
+package swim
+
+import (
+	"fmt"
+	"testing"
+)
+
+type testWeight float64
+
+func (w testWeight) Weight() float64 {
+	return float64(w)
+}
+
+// A membership hash as implemented by HashRing and RendezvousHash.
+type testMemberHash interface {
+	Update(node Node)
+	Watch(updates <-chan Node)
+	Lookup(key []byte) []Node
+	Len() int
+}
+
+// Test the lookups of the membership hash as members join and die.
+func testMemberHashLookup(t *testing.T, h testMemberHash) {
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key %d", i))
+	}
+	lookup := func() []uint64 {
+		ids := make([]uint64, len(keys))
+		for i, key := range keys {
+			ids[i] = h.Lookup(key)[0].Id
+		}
+		return ids
+	}
+
+	if nodes := h.Lookup(keys[0]); len(nodes) != 0 {
+		t.Fatalf("expected no nodes got %v", nodes)
+	}
+
+	// node 4 has twice the weight
+	for id := uint64(1); id <= 4; id += 1 {
+		node := Node{Id: id, State: Alive, UserData: testWeight(1)}
+		if id == 4 {
+			node.UserData = testWeight(2)
+		}
+		h.Update(node)
+	}
+	if n := h.Len(); n != 4 {
+		t.Fatalf("expected 4 members got %v", n)
+	}
+
+	// keys spread by weight
+	before := lookup()
+	counts := map[uint64]int{}
+	for _, id := range before {
+		counts[id] += 1
+	}
+	for id := uint64(1); id <= 4; id += 1 {
+		expect := len(keys) / 5
+		if id == 4 {
+			expect *= 2
+		}
+		if c := counts[id]; c < expect*3/4 || c > expect*5/4 {
+			t.Fatalf("expected about %v keys for node %v got %v", expect, id, c)
+		}
+	}
+
+	// replicas are distinct
+	for _, key := range keys[:100] {
+		nodes := h.Lookup(key)
+		if len(nodes) != 3 {
+			t.Fatalf("expected 3 replicas got %v", len(nodes))
+		}
+		if nodes[0].Id == nodes[1].Id || nodes[0].Id == nodes[2].Id || nodes[1].Id == nodes[2].Id {
+			t.Fatalf("expected distinct replicas got %v", nodes)
+		}
+	}
+
+	// a joining node only takes keys
+	h.Update(Node{Id: 5, State: Alive})
+	after := lookup()
+	moved := 0
+	for i := range keys {
+		if before[i] != after[i] {
+			moved += 1
+			if after[i] != 5 {
+				t.Fatalf("expected key %v to move to node 5 got %v", i, after[i])
+			}
+		}
+	}
+	if moved < len(keys)/12 || moved > len(keys)/4 {
+		t.Fatalf("expected about %v keys to move got %v", len(keys)/6, moved)
+	}
+
+	// a dying node only gives up its keys
+	h.Update(Node{Id: 2, State: Dead})
+	before, after = after, lookup()
+	for i := range keys {
+		if before[i] != after[i] && before[i] != 2 {
+			t.Fatalf("expected key %v to stay at node %v got %v", i, before[i], after[i])
+		} else if after[i] == 2 {
+			t.Fatalf("expected key %v to leave node 2", i)
+		}
+	}
+
+	// suspect nodes stay members
+	h.Update(Node{Id: 1, State: Suspect, UserData: testWeight(1)})
+	before, after = after, lookup()
+	for i := range keys {
+		if before[i] != after[i] {
+			t.Fatalf("expected key %v to stay at node %v got %v", i, before[i], after[i])
+		}
+	}
+	if n := h.Lookup(keys[0])[0]; n.Id == 1 && n.State != Suspect {
+		t.Fatalf("expected updated node got %v", n)
+	}
+
+	// watch updates
+	updates := make(chan Node)
+	done := make(chan struct{})
+	go func() {
+		h.Watch(updates)
+		close(done)
+	}()
+	for id := uint64(1); id <= 5; id += 1 {
+		updates <- Node{Id: id, State: Dead}
+	}
+	close(updates)
+	<-done
+	if n := h.Len(); n != 0 {
+		t.Fatalf("expected no members got %v", n)
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	testMemberHashLookup(t, &HashRing{Replicas: 3})
+
+	// zero weight nodes have no keys
+	r := &HashRing{Weight: func(node *Node) float64 { return float64(node.Id % 2) }}
+	r.Update(Node{Id: 1})
+	r.Update(Node{Id: 2})
+	for i := 0; i < 100; i += 1 {
+		if nodes := r.Lookup([]byte{byte(i)}); len(nodes) != 1 || nodes[0].Id != 1 {
+			t.Fatalf("expected node 1 got %v", nodes)
+		}
+	}
+	if n := len(r.points); n != kHashRingVirtualNodes {
+		t.Fatalf("expected %v points got %v", kHashRingVirtualNodes, n)
+	}
+
+	// forward watched updates
+	r.UpdateCh = make(chan Node, 1)
+	updates := make(chan Node, 1)
+	updates <- Node{Id: 2, State: Dead}
+	close(updates)
+	r.Watch(updates)
+	if node := <-r.UpdateCh; node.Id != 2 {
+		t.Fatalf("expected node 2 got %v", node)
+	}
+}
@@ -47,3 +47,8 @@ func (c *LZ4Codec) Encode(coded *CodedMessage) error {
 
 	return nil
 }
+
+// Implementation of SizingCodec.NewSizer()
+func (c *LZ4Codec) NewSizer(message *Message) (Sizer, error) {
+	return newEventSizer(c.Codec, message, lz4.CompressBound)
+}
@@ -7,3 +7,7 @@ import (
 func TestLZ4Codec(t *testing.T) {
 	testCodec(t, &LZ4Codec{new(GobCodec)})
 }
+
+func TestLZ4CodecSizer(t *testing.T) {
+	testSizer(t, &LZ4Codec{new(GobCodec)}, -1)
+}
@@ -45,6 +45,12 @@ func (m *Message) AddEvent(events ...interface{}) {
 			event = interface{}(*e)
 		case *AntiEntropyEvent:
 			event = interface{}(*e)
+		case *CoordinateEvent:
+			event = interface{}(*e)
+		case *DigestEvent:
+			event = interface{}(*e)
+		case *DigestRequestEvent:
+			event = interface{}(*e)
 		case *AliveEvent:
 			event = interface{}(*e)
 		case *SuspectEvent:
@@ -60,6 +66,9 @@ func (m *Message) AddEvent(events ...interface{}) {
 		case IndirectPingEvent:
 		case IndirectAckEvent:
 		case AntiEntropyEvent:
+		case CoordinateEvent:
+		case DigestEvent:
+		case DigestRequestEvent:
 		case AliveEvent:
 		case SuspectEvent:
 		case DeathEvent:
@@ -39,10 +39,13 @@ type Node struct {
 
 // InternalNode maintains the state of a node in the failure detector.
 type InternalNode struct {
-	RTT               RTT       // Round-trip time estimator
-	RemoteIncarnation Seq       // Incarnation number of the local node at this node
-	LastAckTime       time.Time // Last time the node acknowledged a ping
-	SuspectTime       time.Time // Time when the node became suspect
+	RTT               RTT         // Round-trip time estimator
+	RemoteIncarnation Seq         // Incarnation number of the local node at this node
+	RemoteViewHash    uint64      // View hash last acknowledged by this node, if sent
+	Coord             *Coordinate // Last known network coordinate, if sent
+	LastAckTime       time.Time   // Last time the node acknowledged a ping
+	SuspectTime       time.Time   // Time when the node became suspect
+	viewEntry         uint64      // Hash of the entry in the view hash, if live
 
 	Node
 	SortValue uint64 // For the sorting implementations
@@ -0,0 +1,25 @@
+package swim
+
+import (
+	"time"
+)
+
+// A ping delegate attaches small application payloads, such as the load or
+// queue depth of the local node, to the acks sent in reply to pings, and
+// receives the payloads of the acks to the pings of the local node, so that
+// the application can exchange such data without extra messages.
+type PingDelegate interface {
+
+	// Get the payload to attach to an ack. The payload counts against the
+	// size of the message and should be kept small. This is called from the
+	// event loop with the detector locked, so it must return quickly and must
+	// not call the detector.
+	AckPayload() []byte
+
+	// Receive the payload of an ack from the node and the RTT measured for
+	// the ping. The RTT of an indirect ack includes the relay through the
+	// helper node. The node and payload must not be modified. This is called
+	// from the event loop once the message with the ack has been handled and
+	// the detector unlocked, and the loop blocks until it returns.
+	NotifyPingComplete(node *Node, rtt time.Duration, payload []byte)
+}
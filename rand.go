@@ -0,0 +1,31 @@
+package swim
+
+import (
+	"math/rand"
+)
+
+// Get a random integer in [0, n) from the source, or from the global source
+// if nil.
+func randIntn(r *rand.Rand, n int) int {
+	if r != nil {
+		return r.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+// Get a random float in [0, 1) from the source, or from the global source if
+// nil.
+func randFloat64(r *rand.Rand) float64 {
+	if r != nil {
+		return r.Float64()
+	}
+	return rand.Float64()
+}
+
+// Shuffle the nodes using the source, or the global source if nil.
+func shuffleNodes(r *rand.Rand, nodes []*InternalNode) {
+	for i := len(nodes) - 1; i > 0; i -= 1 {
+		j := randIntn(r, i+1)
+		nodes[i], nodes[j] = nodes[j], nodes[i]
+	}
+}
@@ -0,0 +1,110 @@
+package swim
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// A rendezvous hash maps keys to member nodes by highest random weight
+// hashing: each node scores each key by a hash of the pair, scaled by the
+// weight of the node, and a key maps to the nodes with the highest scores.
+// When a node joins or dies, only the keys for which it has one of the
+// highest scores move. Unlike a HashRing, a rendezvous hash keeps no
+// virtual nodes, but a lookup takes O(n) time.
+//
+// The hash is driven by the membership updates of a detector, as for a
+// HashRing. The methods are safe to run concurrently, but the parameters
+// must not change after the first update.
+type RendezvousHash struct {
+	Replicas int                      // Number of distinct nodes per key, or 1 if zero
+	Weight   func(node *Node) float64 // Weight of each node, or the UserDataWeight if nil
+	UpdateCh chan Node                // If not nil, channel on which to forward watched updates
+
+	l       sync.RWMutex
+	members map[uint64]hashMember // Members by ID
+}
+
+// Apply a membership update: add or update the node, or remove it if dead.
+func (r *RendezvousHash) Update(node Node) {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.members == nil {
+		r.members = make(map[uint64]hashMember)
+	}
+
+	if node.State == Dead {
+		delete(r.members, node.Id)
+	} else {
+		r.members[node.Id] = hashMember{node, nodeWeight(r.Weight, &node)}
+	}
+}
+
+// Apply the updates received on the channel, such as the UpdateCh of a
+// detector, until the channel is closed, forwarding each update to the
+// UpdateCh of the hash if not nil.
+func (r *RendezvousHash) Watch(updates <-chan Node) {
+	for node := range updates {
+		r.Update(node)
+		if r.UpdateCh != nil {
+			r.UpdateCh <- node
+		}
+	}
+}
+
+// Get the nodes for the key, in order of preference: the Replicas nodes
+// with the highest scores for the key.
+func (r *RendezvousHash) Lookup(key []byte) []Node {
+	r.l.RLock()
+	defer r.l.RUnlock()
+
+	n := replicas(r.Replicas, len(r.members))
+	if n == 0 {
+		return nil
+	}
+
+	// score the nodes
+	type score struct {
+		id    uint64
+		score float64
+	}
+	h := keyHash(key)
+	scores := make([]score, 0, len(r.members))
+	for id, m := range r.members {
+		if m.weight > 0 {
+			scores = append(scores, score{id, rendezvousScore(pointHash(id, h), m.weight)})
+		}
+	}
+
+	// pick the highest scores
+	sort.Slice(scores, func(i, j int) bool {
+		if a, b := scores[i].score, scores[j].score; a != b {
+			return a > b
+		}
+		return scores[i].id < scores[j].id
+	})
+	if n > len(scores) {
+		n = len(scores)
+	}
+	nodes := make([]Node, n)
+	for i := range nodes {
+		nodes[i] = r.members[scores[i].id].node
+	}
+	return nodes
+}
+
+// Get the number of member nodes.
+func (r *RendezvousHash) Len() int {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	return len(r.members)
+}
+
+// Calculate the weighted score of a hash, such that a node with twice the
+// weight has twice the chance of the highest score: -weight / ln(u), where
+// u is the hash mapped uniformly into (0, 1).
+func rendezvousScore(hash uint64, weight float64) float64 {
+	u := (float64(hash>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
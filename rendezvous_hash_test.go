@@ -0,0 +1,19 @@
+package swim
+
+import (
+	"testing"
+)
+
+func TestRendezvousHash(t *testing.T) {
+	testMemberHashLookup(t, &RendezvousHash{Replicas: 3})
+
+	// zero weight nodes have no keys
+	r := &RendezvousHash{Weight: func(node *Node) float64 { return float64(node.Id % 2) }}
+	r.Update(Node{Id: 1})
+	r.Update(Node{Id: 2})
+	for i := 0; i < 100; i += 1 {
+		if nodes := r.Lookup([]byte{byte(i)}); len(nodes) != 1 || nodes[0].Id != 1 {
+			t.Fatalf("expected node 1 got %v", nodes)
+		}
+	}
+}
@@ -10,3 +10,11 @@ type SelectionList interface {
 	List() []*InternalNode
 	Len() int
 }
+
+// A helper list selects the nodes to ask for indirect probes separately from
+// the nodes to probe, so that asking a node for help doesn't take its turn
+// to be probed.
+type HelperList interface {
+	SelectionList
+	Helper() *InternalNode
+}
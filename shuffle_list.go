@@ -7,6 +7,7 @@ import (
 // A shuffle list selects nodes round-robin, shuffling the list after each
 // round. The methods are not safe to run concurrently.
 type ShuffleList struct {
+	Rand      *rand.Rand      // Source of randomness, or the global source if nil
 	nodes     []*InternalNode // List of nodes
 	nextIndex int
 }
@@ -101,10 +102,7 @@ func (l *ShuffleList) Replace(nodes []*InternalNode) {
 
 // Shuffle the list.
 func (l *ShuffleList) Shuffle() {
-	for i := len(l.nodes) - 1; i > 0; i -= 1 {
-		j := rand.Intn(i + 1)
-		l.nodes[i], l.nodes[j] = l.nodes[j], l.nodes[i]
-	}
+	shuffleNodes(l.Rand, l.nodes)
 }
 
 // Get a list of the contained nodes. The returned list references the
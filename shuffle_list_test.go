@@ -1,6 +1,7 @@
 package swim
 
 import (
+	"math/rand"
 	"testing"
 )
 
@@ -88,3 +89,21 @@ func TestShuffleList(t *testing.T) {
 		t.Fatalf("expected list of size %v got %v", 1, l)
 	}
 }
+
+func TestShuffleListRand(t *testing.T) {
+	nodes := make([]*InternalNode, 100)
+	for i := range nodes {
+		nodes[i] = &InternalNode{Node: Node{Id: uint64(i + 1)}}
+	}
+
+	a := &ShuffleList{Rand: rand.New(rand.NewSource(42))}
+	b := &ShuffleList{Rand: rand.New(rand.NewSource(42))}
+	a.Replace(append([]*InternalNode(nil), nodes...))
+	b.Replace(append([]*InternalNode(nil), nodes...))
+
+	for i := 0; i < 3*len(nodes); i += 1 {
+		if x, y := a.Next(), b.Next(); x != y {
+			t.Fatalf("expected same order at %v, got %v and %v", i, x.Id, y.Id)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	// "os/signal"
 	"runtime"
+	"sort"
 	// "syscall"
 	"time"
 
@@ -19,6 +20,13 @@ var R *uint = flag.Uint("r", 8, "number of runs")
 var K *uint = flag.Uint("k", 1, "number of buckets")
 var P *uint = flag.Uint("p", 1, "number of direct probes")
 var D *string = flag.String("d", "ring", "distance D")
+var Scenario *string = flag.String("scenario", "convergence", "scenario to run: convergence, churn, or a scenario file")
+var Join *float64 = flag.Float64("join", 0.5, "churn joins per second")
+var Leave *float64 = flag.Float64("leave", 0.25, "churn graceful leaves per second")
+var Crash *float64 = flag.Float64("crash", 0.25, "churn crashes per second")
+var Duration *time.Duration = flag.Duration("duration", time.Minute, "churn duration")
+var Seed *int64 = flag.Int64("seed", 0, "random seed, defaults to the current time")
+var Curves *bool = flag.Bool("curves", false, "print the infection curves of scenario broadcasts")
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -33,41 +41,132 @@ func main() {
 	// 	}
 	// }()
 
+	if len(os.Args) > 1 && os.Args[1] == "sweep" {
+		sweep(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	l := log.New(os.Stdout, "", 0)
 
-	r := NewSimConvergenceRunner()
-	r.K = *K
-	r.P = *P
-
+	var sorter Sorter
+	k := *K
 	d := *D
 	switch d {
 	case "xor":
-		r.D = XorSorter
+		sorter = XorSorter
 	case "finger":
-		r.D = FingerSorter
+		sorter = FingerSorter
 	case "ring":
-		r.D = RingSorter
+		sorter = RingSorter
 	default:
-		r.K = 1
+		k = 1
 		d = "none"
 	}
 
+	var logger *log.Logger
 	if *verbose {
-		r.Logger = log.New(os.Stderr, "", 0)
+		logger = log.New(os.Stderr, "", 0)
 	}
 
-	// ts := make([]time.Duration, *R)
-	// fs := make([]time.Duration, *R)
-	for i := uint(0); i < *R; i += 1 {
-		first, last := r.Measure(*N)
-		l.Printf("%d\t%v\t%v\t%d\t%d\t%s", *N, first, last, r.K, r.P, d)
+	// runs are reproducible given the seed
+	seed := *Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
 	}
 
-	// fmean, fstddev := stat(fs)
-	// tmean, tstddev := stat(ts)
-	// l.Printf("%d\t%v\t%v\t%v\t%v\t%d\t%d\t%s\t%d", *N, fmean, fstddev, tmean, tstddev, r.K, r.P, d, *R)
+	switch *Scenario {
+	case "convergence":
+		r := NewSimConvergenceRunner()
+		r.K = k
+		r.P = *P
+		r.D = sorter
+		r.Seed = seed
+		r.Logger = logger
+
+		// ts := make([]time.Duration, *R)
+		// fs := make([]time.Duration, *R)
+		for i := uint(0); i < *R; i += 1 {
+			first, last := r.Measure(*N)
+			l.Printf("%d\t%v\t%v\t%d\t%d\t%s\t%d", *N, first, last, r.K, r.P, d, seed)
+		}
+
+		// fmean, fstddev := stat(fs)
+		// tmean, tstddev := stat(ts)
+		// l.Printf("%d\t%v\t%v\t%v\t%v\t%d\t%d\t%s\t%d", *N, fmean, fstddev, tmean, tstddev, r.K, r.P, d, *R)
+
+	case "churn":
+		r := NewSimChurnRunner()
+		r.K = k
+		r.P = *P
+		r.D = sorter
+		r.JoinRate = *Join
+		r.LeaveRate = *Leave
+		r.CrashRate = *Crash
+		r.Logger = logger
+
+		for i := uint(0); i < *R; i += 1 {
+			r.Seed = seed + int64(i)
+			res := r.Measure(*N, *Duration)
+			stale, _ := stat(res.StaleLifetimes)
+			l.Printf("%d\t%.4f\t%v\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t%d",
+				*N, res.Accuracy(), stale, res.Stale, res.FalseDeaths,
+				res.Joins, res.Leaves, res.Crashes, r.K, r.P, d, r.Seed)
+		}
+
+	default:
+		s, err := LoadSimScenario(*Scenario)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		r := NewSimScenarioRunner()
+		r.Logger = logger
+
+		failed := false
+		for i := uint(0); i < *R; i += 1 {
+			r.Seed = seed + int64(i)
+			l.Printf("%s\tSEED\t%d", s.Name, r.Seed)
+			res, err := r.Run(s)
+			if err != nil {
+				l.Printf("%s\tERROR\t%v", s.Name, err)
+				failed = true
+				continue
+			}
+
+			for _, a := range res.Assertions {
+				status := "PASS"
+				if !a.Pass {
+					status = "FAIL"
+					failed = true
+				}
+				l.Printf("%s\t%s\t%s\t%s", s.Name, status, a.Check, a.Detail)
+			}
+
+			keys := []string(nil)
+			for key := range res.Metrics {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				l.Printf("%s\tMETRIC\t%s\t%v", s.Name, key, res.Metrics[key])
+			}
+
+			if *Curves {
+				for j, c := range res.Curves {
+					for k, t := range c.Receipts {
+						l.Printf("%s\tCURVE\t%d\t%v\t%v\t%d", s.Name, j,
+							t.Seconds(), float64(k+1)/float64(c.Nodes), c.Hops[k])
+					}
+				}
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	}
 }
 
 func stat(ts []time.Duration) (mean, stddev time.Duration) {
@@ -80,6 +179,10 @@ func stat(ts []time.Duration) (mean, stddev time.Duration) {
 	}
 
 	n := float64(len(ts))
+	if n == 0 {
+		return
+	}
+
 	var2 := float64(0)
 	if n > 1 {
 		var2 = (n*ss - sum*sum) / (n * (n - 1))
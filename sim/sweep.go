@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/mikepb/go-swim"
+)
+
+// A sweep point identifies one combination of simulator parameters.
+type point struct {
+	N      uint    `json:"n"`
+	K      uint    `json:"k"`
+	P      uint    `json:"p"`
+	Metric string  `json:"metric"`
+	Codec  string  `json:"codec"`
+	Loss   float64 `json:"loss"`
+}
+
+// A run records the outcome of one measurement at a sweep point. Runs are
+// appended to the state file as they complete so that an interrupted sweep
+// can be resumed.
+type run struct {
+	point
+	Base     int64         `json:"base"` // Seed of the stream of run seeds
+	Seed     int64         `json:"seed"`
+	First    time.Duration `json:"first"`
+	Last     time.Duration `json:"last"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+}
+
+// A summary aggregates the runs at a sweep point.
+type summary struct {
+	point
+	Runs        int     `json:"runs"`
+	Timeouts    int     `json:"timeouts"`
+	FirstMean   float64 `json:"first_mean"`
+	FirstStdDev float64 `json:"first_stddev"`
+	FirstCI     float64 `json:"first_ci95"`
+	LastMean    float64 `json:"last_mean"`
+	LastStdDev  float64 `json:"last_stddev"`
+	LastCI      float64 `json:"last_ci95"`
+}
+
+// Run a parameter sweep of the convergence simulation.
+func sweep(args []string) {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	ns := fs.String("n", "4:128", "number of nodes")
+	ks := fs.String("k", "1", "number of buckets")
+	ps := fs.String("p", "1", "number of direct probes")
+	ds := fs.String("d", "none", "distance metrics: none, ring, xor, finger")
+	cs := fs.String("codec", "flate", "codecs: gob, flate, lz4")
+	ls := fs.String("loss", "0", "fractions of messages to drop")
+	runs := fs.Uint("runs", 8, "number of runs per point")
+	retries := fs.Uint("retries", 3, "number of retries after a run times out")
+	timeout := fs.Duration("timeout", 10*time.Minute, "timeout per run")
+	out := fs.String("o", "", "output file, defaults to standard output")
+	format := fs.String("format", "csv", "output format: csv or json")
+	state := fs.String("state", "sweep.jsonl", "file in which to save runs for resuming")
+	seed := fs.Int64("seed", 0, "seed from which to generate the run seeds, defaults to the seed in the state file or the current time")
+	verbose := fs.Bool("verbose", false, "verbose")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sim sweep [flags]")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Ranges are lists (1,2,4), doubling ranges (lo:hi), or linear ranges (lo:hi:step).")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *format != "csv" && *format != "json" {
+		log.Fatalf("unknown format %q", *format)
+	}
+
+	// enumerate the sweep points
+	points := []point(nil)
+	for _, d := range strings.Split(*ds, ",") {
+		for _, k := range parseUints(*ks) {
+			// buckets are meaningless without a distance metric
+			if d == "none" && k > 1 {
+				continue
+			}
+			for _, p := range parseUints(*ps) {
+				for _, c := range strings.Split(*cs, ",") {
+					for _, loss := range parseFloats(*ls) {
+						for _, n := range parseUints(*ns) {
+							points = append(points, point{n, k, p, d, c, loss})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// resume from the saved runs
+	f, err := os.OpenFile(*state, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	results := make(map[point][]run)
+	recorded := 0
+	base := int64(0)
+	offset := int64(0)
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		var r run
+		if err == io.EOF || json.Unmarshal(line, &r) != nil {
+			// ignore a partially written last line
+			log.Printf("ignoring rest of %s after byte %d", *state, offset)
+			break
+		}
+		offset += int64(len(line))
+		results[r.point] = append(results[r.point], r)
+		recorded += 1
+		base = r.Base
+	}
+
+	// write new runs after the last good run, so that a later resume does
+	// not stop at a partially written line and drop the runs after it
+	if err := f.Truncate(offset); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+
+	var logger *log.Logger
+	if *verbose {
+		logger = log.New(os.Stderr, "", 0)
+	}
+
+	// each run records its seed so that it can be reproduced, and the seed
+	// of the stream of run seeds so that a resumed sweep continues the
+	// stream after the recorded runs instead of reusing their seeds
+	if recorded > 0 {
+		if *seed != 0 && *seed != base {
+			log.Fatalf("%s was recorded with seed %d, not %d", *state, base, *seed)
+		}
+		*seed = base
+	} else if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	seeds := rand.New(rand.NewSource(*seed))
+	for i := 0; i < recorded; i += 1 {
+		seeds.Int63()
+	}
+
+	// measure the remaining runs
+	for _, pt := range points {
+		for completed(results[pt]) < int(*runs) {
+			r := measure(pt, *seed, seeds.Int63(), *timeout, logger)
+			for i := uint(0); r.TimedOut && i < *retries; i += 1 {
+				log.Printf("%+v timed out with seed %d, retrying", pt, r.Seed)
+				results[pt] = append(results[pt], r)
+				if err := enc.Encode(r); err != nil {
+					log.Fatal(err)
+				}
+				r = measure(pt, *seed, seeds.Int63(), *timeout, logger)
+			}
+			results[pt] = append(results[pt], r)
+			if err := enc.Encode(r); err != nil {
+				log.Fatal(err)
+			}
+			if r.TimedOut {
+				log.Printf("%+v timed out with seed %d, skipping", pt, r.Seed)
+				break
+			}
+		}
+	}
+	f.Close()
+
+	// summarize
+	summaries := make([]summary, len(points))
+	for i, pt := range points {
+		summaries[i] = summarize(pt, results[pt])
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(summaries)
+	} else {
+		err = writeCSV(w, summaries)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Count the runs that completed without timing out.
+func completed(runs []run) (n int) {
+	for _, r := range runs {
+		if !r.TimedOut {
+			n += 1
+		}
+	}
+	return
+}
+
+// Measure one run at the given sweep point, with the given seed from the
+// stream of run seeds of the base seed.
+func measure(pt point, base, seed int64, timeout time.Duration, logger *log.Logger) run {
+	r := NewSimConvergenceRunner()
+	r.Seed = seed
+	r.K = pt.K
+	r.P = pt.P
+	r.Loss = pt.Loss
+	r.Logger = logger
+
+	switch pt.Metric {
+	case "xor":
+		r.D = XorSorter
+	case "finger":
+		r.D = FingerSorter
+	case "ring":
+		r.D = RingSorter
+	default:
+		r.K = 1
+	}
+
+	switch pt.Codec {
+	case "gob":
+		r.Codec = func() Codec { return new(GobCodec) }
+	case "lz4":
+		r.Codec = func() Codec { return &LZ4Codec{Codec: new(GobCodec)} }
+	case "flate":
+		r.Codec = func() Codec { return &FlateCodec{Codec: new(GobCodec)} }
+	default:
+		log.Fatalf("unknown codec %q", pt.Codec)
+	}
+
+	first, last, err := r.MeasureWithin(pt.N, timeout)
+	r.Reset()
+	return run{point: pt, Base: base, Seed: seed, First: first, Last: last, TimedOut: err == ErrSimTimeout}
+}
+
+// Summarize the completed runs at a sweep point.
+func summarize(pt point, runs []run) summary {
+	s := summary{point: pt}
+
+	firsts := []time.Duration(nil)
+	lasts := []time.Duration(nil)
+	for _, r := range runs {
+		if r.TimedOut {
+			s.Timeouts += 1
+		} else {
+			firsts = append(firsts, r.First)
+			lasts = append(lasts, r.Last)
+		}
+	}
+	s.Runs = len(firsts)
+
+	mean, stddev := stat(firsts)
+	s.FirstMean = mean.Seconds()
+	s.FirstStdDev = stddev.Seconds()
+	s.FirstCI = ci95(stddev, s.Runs).Seconds()
+
+	mean, stddev = stat(lasts)
+	s.LastMean = mean.Seconds()
+	s.LastStdDev = stddev.Seconds()
+	s.LastCI = ci95(stddev, s.Runs).Seconds()
+
+	return s
+}
+
+// Two-sided 95% critical values of Student's t-distribution for 1 to 30
+// degrees of freedom.
+var tTable = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// Calculate the half-width of the 95% confidence interval of the mean.
+func ci95(stddev time.Duration, n int) time.Duration {
+	if n < 2 {
+		return 0
+	}
+	t := 1.96
+	if df := n - 1; df <= len(tTable) {
+		t = tTable[df-1]
+	}
+	return time.Duration(t * float64(stddev) / math.Sqrt(float64(n)))
+}
+
+func writeCSV(w io.Writer, summaries []summary) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"n", "k", "p", "metric", "codec", "loss", "runs", "timeouts",
+		"first_mean", "first_stddev", "first_ci95",
+		"last_mean", "last_stddev", "last_ci95",
+	})
+	for _, s := range summaries {
+		cw.Write([]string{
+			fmt.Sprint(s.N), fmt.Sprint(s.K), fmt.Sprint(s.P), s.Metric, s.Codec,
+			fmt.Sprint(s.Loss), fmt.Sprint(s.Runs), fmt.Sprint(s.Timeouts),
+			fmt.Sprint(s.FirstMean), fmt.Sprint(s.FirstStdDev), fmt.Sprint(s.FirstCI),
+			fmt.Sprint(s.LastMean), fmt.Sprint(s.LastStdDev), fmt.Sprint(s.LastCI),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Parse a list (1,2,4), doubling range (lo:hi), or linear range
+// (lo:hi:step) of unsigned integers.
+func parseUints(s string) (vs []uint) {
+	for _, part := range strings.Split(s, ",") {
+		r := strings.Split(part, ":")
+		bounds := make([]uint, len(r))
+		for i, v := range r {
+			u, err := strconv.ParseUint(v, 10, 0)
+			if err != nil {
+				log.Fatalf("invalid range %q: %v", s, err)
+			}
+			bounds[i] = uint(u)
+		}
+		switch len(bounds) {
+		case 1:
+			vs = append(vs, bounds[0])
+		case 2:
+			if bounds[0] == 0 {
+				log.Fatalf("invalid doubling range %q", part)
+			}
+			for v := bounds[0]; v <= bounds[1]; v += v {
+				vs = append(vs, v)
+			}
+		case 3:
+			if bounds[2] == 0 {
+				log.Fatalf("invalid linear range %q", part)
+			}
+			for v := bounds[0]; v <= bounds[1]; v += bounds[2] {
+				vs = append(vs, v)
+			}
+		default:
+			log.Fatalf("invalid range %q", part)
+		}
+	}
+	return
+}
+
+// Parse a list of floats.
+func parseFloats(s string) (vs []float64) {
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			log.Fatalf("invalid list %q: %v", s, err)
+		}
+		vs = append(vs, v)
+	}
+	return
+}
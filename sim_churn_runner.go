@@ -0,0 +1,369 @@
+package swim
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Run a simulator that measures the accuracy of the membership views while
+// nodes continuously join, gracefully leave, and crash.
+type SimChurnRunner struct {
+	Logger    *log.Logger
+	K         uint
+	P         uint
+	D         Sorter
+	JoinRate  float64       // Mean number of joins per second
+	LeaveRate float64       // Mean number of graceful leaves per second
+	CrashRate float64       // Mean number of crashes per second
+	Interval  time.Duration // Time between samples of the membership views
+	Seed      int64         // Seed for all random choices
+	l         sync.Mutex
+	router    *SimRouter
+	rand      *rand.Rand
+
+	instances map[uint64]*Detector
+	departed  map[uint64]time.Time
+	result    *SimChurnResult
+}
+
+// A churn sample records the accuracy of the membership views at a point in
+// time.
+type SimChurnSample struct {
+	Time     time.Duration // Time since the start of the churn
+	Live     int           // Number of live nodes
+	Agree    int           // Number of live nodes that agree on the live set
+	Accuracy float64       // Fraction of live nodes that agree on the live set
+}
+
+// The churn result summarizes a churn simulation.
+type SimChurnResult struct {
+	Samples        []SimChurnSample // View accuracy over time
+	Joins          int              // Number of nodes that joined
+	Leaves         int              // Number of nodes that gracefully left
+	Crashes        int              // Number of nodes that crashed
+	StaleLifetimes []time.Duration  // Time until departed nodes left all views
+	Stale          int              // Number of departed nodes still in a view
+	FalseDeaths    int              // Number of live nodes declared dead
+}
+
+// Calculate the mean fraction of live nodes that agree on the live set.
+func (r *SimChurnResult) Accuracy() float64 {
+	if len(r.Samples) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, s := range r.Samples {
+		sum += s.Accuracy
+	}
+	return sum / float64(len(r.Samples))
+}
+
+func NewSimChurnRunner() *SimChurnRunner {
+	return &SimChurnRunner{
+		K:        1,
+		P:        1,
+		Interval: 100 * time.Millisecond,
+		Seed:     time.Now().UnixNano(),
+	}
+}
+
+// Start n nodes, wait for their views to agree, then subject the group to
+// churn for the given duration.
+func (r *SimChurnRunner) Measure(n uint, duration time.Duration) *SimChurnResult {
+	runtime.GC()
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	r.rand = rand.New(rand.NewSource(r.Seed))
+	r.router = NewSimRouterWithSeed(r.rand.Int63())
+	r.instances = make(map[uint64]*Detector)
+	r.departed = make(map[uint64]time.Time)
+	r.result = new(SimChurnResult)
+	defer r.reset()
+
+	if r.Logger != nil {
+		r.Logger.Println("C START")
+	}
+	r.start(n)
+
+	// wait for the initial views to agree
+	for {
+		if s := r.sample(time.Now()); s.Accuracy == 1.0 {
+			break
+		}
+		r.l.Unlock()
+		time.Sleep(r.Interval)
+		r.l.Lock()
+	}
+
+	// discard departures and deaths from starting up
+	r.result = new(SimChurnResult)
+
+	if r.Logger != nil {
+		r.Logger.Println("C CHURN")
+	}
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	timer := time.NewTimer(r.nextChurn())
+	defer timer.Stop()
+
+	t := time.Now()
+	end := time.After(duration)
+
+	for {
+		r.l.Unlock()
+		select {
+		case <-end:
+			r.l.Lock()
+			r.result.Stale = len(r.departed)
+			if r.Logger != nil {
+				r.Logger.Println("C DONE")
+			}
+			return r.result
+
+		case now := <-ticker.C:
+			r.l.Lock()
+			s := r.sample(now)
+			s.Time = now.Sub(t)
+			r.result.Samples = append(r.result.Samples, s)
+
+		case <-timer.C:
+			r.l.Lock()
+			r.churn()
+			timer.Reset(r.nextChurn())
+		}
+	}
+}
+
+// Generate the exponentially distributed time until the next churn event.
+func (r *SimChurnRunner) nextChurn() time.Duration {
+	rate := r.JoinRate + r.LeaveRate + r.CrashRate
+	if rate <= 0 {
+		return 365 * 24 * time.Hour
+	}
+	return time.Duration(r.rand.ExpFloat64() / rate * float64(time.Second))
+}
+
+// Join, leave, or crash a node in proportion to the configured rates.
+func (r *SimChurnRunner) churn() {
+	x := r.rand.Float64() * (r.JoinRate + r.LeaveRate + r.CrashRate)
+
+	switch {
+	case x < r.JoinRate:
+		r.join()
+	case len(r.instances) <= 2:
+		// keep a group around
+	case x < r.JoinRate+r.LeaveRate:
+		r.depart(true)
+	default:
+		r.depart(false)
+	}
+}
+
+// Start n nodes that join using the addresses of all nodes.
+func (r *SimChurnRunner) start(n uint) {
+	addrs := []string(nil)
+	ds := []*Detector(nil)
+	for i := uint(0); i < n; i += 1 {
+		d := r.newDetector()
+		addrs = append(addrs, d.LocalNode.Addrs...)
+		ds = append(ds, d)
+	}
+
+	for _, d := range ds {
+		d.Join(addrs...)
+		r.l.Unlock()
+		time.Sleep(time.Duration(r.rand.Int63n(int64(d.ProbeInterval))))
+		r.l.Lock()
+	}
+}
+
+// Add a node that joins using the addresses of a few live nodes.
+func (r *SimChurnRunner) join() {
+	addrs := []string(nil)
+	for _, id := range r.ids() {
+		addrs = append(addrs, r.instances[id].LocalNode.Addrs...)
+		if len(addrs) >= 3 {
+			break
+		}
+	}
+
+	d := r.newDetector()
+	if r.Logger != nil {
+		r.Logger.Printf("C JOIN %v", d.LocalNode.Id)
+	}
+	d.Join(addrs...)
+	r.result.Joins += 1
+}
+
+// Remove a random node, either gracefully or by crashing it.
+func (r *SimChurnRunner) depart(graceful bool) {
+	ids := r.ids()
+	id := ids[r.rand.Intn(len(ids))]
+	d := r.instances[id]
+
+	delete(r.instances, id)
+	r.departed[id] = time.Now()
+
+	if r.Logger != nil {
+		r.Logger.Printf("C DEPART %v %v", id, graceful)
+	}
+
+	// don't block the watchers while closing
+	r.l.Unlock()
+	if graceful {
+		d.Leave()
+	}
+	d.Close()
+	d.UpdateCh <- Node{}
+	r.l.Lock()
+
+	delete(r.router.Routes, d.LocalNode.Addrs[0])
+
+	if graceful {
+		r.result.Leaves += 1
+	} else {
+		r.result.Crashes += 1
+	}
+}
+
+// Compare the membership view of each live node with the live set and
+// record the lifetimes of departed nodes that no longer appear in any view.
+func (r *SimChurnRunner) sample(now time.Time) (s SimChurnSample) {
+	stale := make(map[uint64]bool)
+
+	for id, d := range r.instances {
+		agree := true
+		count := 1
+		for _, node := range d.Members() {
+			if _, ok := r.instances[node.Id]; ok {
+				count += 1
+			} else {
+				agree = false
+				stale[node.Id] = true
+			}
+		}
+		if agree && count == len(r.instances) {
+			s.Agree += 1
+		}
+		if r.Logger != nil {
+			r.Logger.Printf("C SAMPLE %v %v/%v", id, count, len(r.instances))
+		}
+	}
+
+	for id, t := range r.departed {
+		if !stale[id] {
+			r.result.StaleLifetimes = append(r.result.StaleLifetimes, now.Sub(t))
+			delete(r.departed, id)
+		}
+	}
+
+	s.Live = len(r.instances)
+	if s.Live > 0 {
+		s.Accuracy = float64(s.Agree) / float64(s.Live)
+	}
+	return
+}
+
+// List the live node IDs in a reproducible order.
+func (r *SimChurnRunner) ids() []uint64 {
+	ids := make([]uint64, 0, len(r.instances))
+	for id := range r.instances {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (r *SimChurnRunner) newDetector() *Detector {
+	for {
+		id := uint64(r.rand.Int63())
+		if _, ok := r.instances[id]; ok {
+			continue
+		} else if _, ok := r.departed[id]; ok {
+			continue
+		}
+
+		addr := fmt.Sprintf("n%020d", id)
+
+		d := &Detector{
+			LocalNode: Node{
+				Id:    id,
+				Addrs: []string{addr},
+			},
+			DirectProbes:   r.P,
+			IndirectProbes: 3,
+			ProbeInterval:  1000 * time.Millisecond,
+			ProbeTimeout:   300 * time.Millisecond,
+			RetransmitMult: 4,
+			SuspicionMult:  5,
+			Transport:      r.router.NewTransport(addr),
+			Codec:          &FlateCodec{new(GobCodec)},
+		}
+
+		d.Logger = r.Logger
+		if r.K <= 1 {
+			d.SelectionList = &ShuffleList{Rand: rand.New(rand.NewSource(r.rand.Int63()))}
+		} else {
+			d.SelectionList = &BucketList{
+				K:         r.K,
+				Sort:      r.D,
+				LocalNode: &d.LocalNode,
+				Rand:      rand.New(rand.NewSource(r.rand.Int63())),
+			}
+		}
+		d.UpdateCh = r.watch(d)
+
+		r.instances[id] = d
+
+		return d
+	}
+}
+
+// Count the live nodes declared dead by other live nodes.
+func (r *SimChurnRunner) watch(d *Detector) chan Node {
+	ch := make(chan Node, 1)
+	id := d.LocalNode.Id
+
+	go func() {
+		for {
+			node, ok := <-ch
+			if !ok || node.Id == 0 {
+				break
+			}
+
+			r.l.Lock()
+			if node.State == Dead && r.instances[id] != nil &&
+				r.instances[node.Id] != nil {
+				if r.Logger != nil {
+					r.Logger.Printf("C FALSE DEATH %v by %v", node.Id, id)
+				}
+				r.result.FalseDeaths += 1
+			}
+			r.l.Unlock()
+		}
+	}()
+
+	return ch
+}
+
+// Close all running nodes.
+func (r *SimChurnRunner) reset() {
+	ds := r.instances
+	r.instances = make(map[uint64]*Detector)
+
+	r.l.Unlock()
+	for _, d := range ds {
+		d.Close()
+		d.UpdateCh <- Node{}
+	}
+	r.l.Lock()
+}
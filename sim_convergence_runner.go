@@ -1,15 +1,20 @@
 package swim
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// The error returned when a simulation does not finish within its timeout.
+var ErrSimTimeout = errors.New("simulation timed out")
+
 // Run a simulator that measures the time for all nodes to agree on the
 // number of members after a failure occurs.
 type SimConvergenceRunner struct {
@@ -17,6 +22,9 @@ type SimConvergenceRunner struct {
 	K         uint
 	P         uint
 	D         Sorter
+	Codec     func() Codec // Codec factory, defaults to flate-compressed gob
+	Loss      float64      // Fraction of messages to drop
+	Seed      int64        // Seed for all random choices, set before measuring
 	l         sync.Mutex
 	c         sync.Cond
 	startTime time.Time
@@ -28,22 +36,44 @@ type SimConvergenceRunner struct {
 	instances map[uint64]*Detector
 	starts    map[uint64]bool
 	expect    uint32
+	timedOut  bool
 }
 
 func NewSimConvergenceRunner() *SimConvergenceRunner {
 	r := &SimConvergenceRunner{
 		K:    1,
 		P:    1,
-		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		Seed: time.Now().UnixNano(),
 	}
 	r.c.L = &r.l
 	r.Reset()
 	return r
 }
 
+// Seed the random source and create the router, if not already done.
+func (r *SimConvergenceRunner) init() {
+	if r.rand == nil {
+		r.rand = rand.New(rand.NewSource(r.Seed))
+	}
+	if r.router == nil {
+		r.router = NewSimRouterWithSeed(r.rand.Int63())
+	}
+}
+
+// List the node IDs in a reproducible order.
+func (r *SimConvergenceRunner) ids() []uint64 {
+	ids := make([]uint64, 0, len(r.instances))
+	for id := range r.instances {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
 func (r *SimConvergenceRunner) populate(n uint) {
 	if l := len(r.instances); l > int(n) {
-		for id, d := range r.instances {
+		for _, id := range r.ids() {
+			d := r.instances[id]
 			if r.Logger != nil {
 				r.Logger.Printf("P REMOVE %v", d.LocalNode.Id)
 			}
@@ -86,7 +116,7 @@ func (r *SimConvergenceRunner) newDetector() *Detector {
 			RetransmitMult: 4,
 			SuspicionMult:  5,
 			Transport:      r.router.NewTransport(addr),
-			Codec:          &FlateCodec{new(GobCodec)},
+			Codec:          r.newCodec(),
 		}
 
 		d.Logger = r.Logger
@@ -99,14 +129,22 @@ func (r *SimConvergenceRunner) newDetector() *Detector {
 	}
 }
 
+func (r *SimConvergenceRunner) newCodec() Codec {
+	if r.Codec == nil {
+		return &FlateCodec{new(GobCodec)}
+	}
+	return r.Codec()
+}
+
 func (r *SimConvergenceRunner) newSelectionList(node *Node) SelectionList {
 	if r.K <= 1 {
-		return new(ShuffleList)
+		return &ShuffleList{Rand: rand.New(rand.NewSource(r.rand.Int63()))}
 	} else {
 		return &BucketList{
 			K:         r.K,
 			Sort:      r.D,
 			LocalNode: node,
+			Rand:      rand.New(rand.NewSource(r.rand.Int63())),
 		}
 	}
 }
@@ -138,7 +176,9 @@ func (r *SimConvergenceRunner) watch(d *Detector) chan Node {
 		r.l.Lock()
 		delete(r.instances, id)
 		delete(r.starts, id)
-		delete(r.router.Routes, d.LocalNode.Addrs[0])
+		if r.router != nil {
+			delete(r.router.Routes, d.LocalNode.Addrs[0])
+		}
 		r.c.Broadcast()
 		r.l.Unlock()
 
@@ -150,29 +190,66 @@ func (r *SimConvergenceRunner) watch(d *Detector) chan Node {
 	return ch
 }
 
+// Determine if the started nodes agree on their membership views, by
+// comparing view hashes, and the views have the expected number of members.
 func (r *SimConvergenceRunner) isDone() bool {
 	expect := int(atomic.LoadUint32(&r.expect))
+	var hash uint64
+	count := expect
+	first := true
 	for id, d := range r.instances {
 		if !r.starts[id] {
 			continue
 		}
-		c := d.ActiveCount()
+		h := d.ViewHash()
+		if first {
+			hash, count = h, d.ActiveCount()
+			first = false
+		}
 		if r.Logger != nil {
-			r.Logger.Printf("W COMPARE %d <> %d", c, expect)
+			r.Logger.Printf("W COMPARE %x <> %x", h, hash)
 		}
-		if c != expect {
+		if h != hash {
 			return false
 		}
 	}
-	return true
+	return count == expect
 }
 
 func (r *SimConvergenceRunner) Measure(n uint) (first, last time.Duration) {
+	first, last, _ = r.MeasureWithin(n, 0)
+	return
+}
+
+// Measure as with Measure(), giving up after the timeout. If the timeout is
+// reached, ErrSimTimeout is returned and the runner is reset. A zero timeout
+// waits indefinitely.
+func (r *SimConvergenceRunner) MeasureWithin(n uint, timeout time.Duration) (first, last time.Duration, err error) {
+	if first, last, err = r.measure(n, timeout); err != nil {
+		r.Reset()
+	}
+	return
+}
+
+func (r *SimConvergenceRunner) measure(n uint, timeout time.Duration) (first, last time.Duration, err error) {
 	runtime.GC()
 
 	r.l.Lock()
 	defer r.l.Unlock()
 
+	r.timedOut = false
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			r.l.Lock()
+			r.timedOut = true
+			r.c.Broadcast()
+			r.l.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	r.init()
+
 	if r.Logger != nil {
 		r.Logger.Println("M POPULATE")
 	}
@@ -182,9 +259,13 @@ func (r *SimConvergenceRunner) Measure(n uint) (first, last time.Duration) {
 		r.Logger.Println("M START")
 	}
 	atomic.StoreUint32(&r.expect, uint32(n)-1)
+	r.router.Loss = r.Loss
 	r.start()
 
 	for !r.isDone() {
+		if r.timedOut {
+			return 0, 0, ErrSimTimeout
+		}
 		if r.Logger != nil {
 			r.Logger.Println("M WAIT START")
 		}
@@ -206,6 +287,9 @@ func (r *SimConvergenceRunner) Measure(n uint) (first, last time.Duration) {
 	r.firstTime = time.Time{}
 
 	for !r.isDone() {
+		if r.timedOut {
+			return 0, 0, ErrSimTimeout
+		}
 		if r.Logger != nil {
 			r.Logger.Println("M WAIT KILL")
 		}
@@ -229,14 +313,16 @@ func (r *SimConvergenceRunner) Measure(n uint) (first, last time.Duration) {
 func (r *SimConvergenceRunner) start() {
 
 	// collect all addresses
+	ids := r.ids()
 	addrs := []string(nil)
-	for _, d := range r.instances {
-		addrs = append(addrs, d.LocalNode.Addrs...)
+	for _, id := range ids {
+		addrs = append(addrs, r.instances[id].LocalNode.Addrs...)
 	}
 
 	// start detectors
-	for id, d := range r.instances {
-		if r.starts[id] {
+	for _, id := range ids {
+		d := r.instances[id]
+		if d == nil || r.starts[id] {
 			continue
 		}
 		r.starts[id] = true
@@ -252,16 +338,22 @@ func (r *SimConvergenceRunner) start() {
 }
 
 func (r *SimConvergenceRunner) kill() {
-	for id, d := range r.instances {
+	for _, id := range r.ids() {
+		d := r.instances[id]
 		if r.Logger != nil {
 			r.Logger.Printf("K CLOSE %v", id)
 		}
 		r.subject = d
+		delete(r.instances, id)
+		delete(r.starts, id)
+
+		// don't block the watchers while closing
+		r.l.Unlock()
 		// d.Stop()
 		d.Close()
 		d.UpdateCh <- Node{}
-		delete(r.instances, id)
-		delete(r.starts, id)
+		r.l.Lock()
+
 		if r.Logger != nil {
 			r.Logger.Printf("K KILLED %v", id)
 		}
@@ -271,13 +363,16 @@ func (r *SimConvergenceRunner) kill() {
 
 func (r *SimConvergenceRunner) Reset() {
 	r.l.Lock()
-	defer r.l.Unlock()
-	for _, d := range r.instances {
-		d.Close()
-		d.UpdateCh <- Node{}
-	}
+	ds := r.instances
 	r.subject = nil
-	r.router = NewSimRouter()
+	r.router = nil
 	r.instances = make(map[uint64]*Detector)
 	r.starts = make(map[uint64]bool)
+	r.l.Unlock()
+
+	// don't block the watchers while closing
+	for _, d := range ds {
+		d.Close()
+		d.UpdateCh <- Node{}
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"math/rand"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,14 +20,26 @@ type SimRouter struct {
 	NetDelay      time.Duration
 	NetStdDev     time.Duration
 	MaxMessageLen int
+	Loss          float64       // Fraction of messages to drop
+	ZoneDelay     time.Duration // Additional delay of messages between zones
 	l             sync.Mutex
+	partitions    map[string]int
+	zones         map[string]string
+	sent          uint64 // Number of messages sent
+	crossZone     uint64 // Number of messages sent between zones
 }
 
-// Create a new SimRouter.
+// Create a new SimRouter seeded from the current time.
 func NewSimRouter() *SimRouter {
+	return NewSimRouterWithSeed(time.Now().UnixNano())
+}
+
+// Create a new SimRouter whose random delays and losses are generated from
+// the given seed.
+func NewSimRouterWithSeed(seed int64) *SimRouter {
 	return &SimRouter{
 		Routes:        make(map[string]*SimTransport),
-		Rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		Rand:          rand.New(rand.NewSource(seed)),
 		NetDelay:      kNetDelay,
 		NetStdDev:     kNetStdDev,
 		MaxMessageLen: kMaxMessageLen,
@@ -40,6 +53,7 @@ func (r *SimRouter) NewTransport(addr string) *SimTransport {
 	t, ok := r.Routes[addr]
 	if !ok {
 		t = NewSimTransport(r)
+		t.Addr = addr
 		r.Routes[addr] = t
 	}
 	return t
@@ -47,7 +61,26 @@ func (r *SimRouter) NewTransport(addr string) *SimTransport {
 
 // Send a message to the first transport matching the addresses.
 func (r *SimRouter) SendTo(addrs []string, message *CodedMessage) error {
+	return r.SendFrom("", addrs, message)
+}
+
+// Send a message from the given address to the first transport matching
+// the addresses, subject to network partitions.
+func (r *SimRouter) SendFrom(from string, addrs []string, message *CodedMessage) error {
 	defer runtime.Gosched()
+	atomic.AddUint64(&r.sent, 1)
+
+	// drop messages across partitions
+	addrs = r.reachable(from, addrs)
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	// count messages between zones
+	crossZone := r.crossesZones(from, addrs[0])
+	if crossZone {
+		atomic.AddUint64(&r.crossZone, 1)
+	}
 
 	deliver := func() {
 		defer func() { recover() }()
@@ -58,7 +91,15 @@ func (r *SimRouter) SendTo(addrs []string, message *CodedMessage) error {
 		}
 	}
 
+	// silently drop to simulate packet loss
+	if r.Drop() {
+		return nil
+	}
+
 	delay := r.Delay()
+	if crossZone {
+		delay += r.ZoneDelay
+	}
 
 	// support no delay
 	if delay == 0 {
@@ -73,6 +114,95 @@ func (r *SimRouter) SendTo(addrs []string, message *CodedMessage) error {
 	return nil
 }
 
+// Get the number of messages sent through the router, including those
+// dropped.
+func (r *SimRouter) Sent() uint64 {
+	return atomic.LoadUint64(&r.sent)
+}
+
+// Get the number of messages sent between zones, including those dropped.
+func (r *SimRouter) CrossZone() uint64 {
+	return atomic.LoadUint64(&r.crossZone)
+}
+
+// Place the address in the given zone. Messages between addresses in
+// different zones are counted and delayed by ZoneDelay.
+func (r *SimRouter) SetZone(addr, zone string) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.zones == nil {
+		r.zones = make(map[string]string)
+	}
+	r.zones[addr] = zone
+}
+
+// Determine if a message between the addresses crosses zones.
+func (r *SimRouter) crossesZones(from, to string) bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.zones == nil || from == "" {
+		return false
+	}
+	return r.zones[from] != r.zones[to]
+}
+
+// Partition the network into groups of addresses. Messages are delivered
+// only between addresses in the same group. Addresses not in any group form
+// a group of their own.
+func (r *SimRouter) Partition(groups ...[]string) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			r.partitions[addr] = i + 1
+		}
+	}
+}
+
+// Heal the network partition.
+func (r *SimRouter) Heal() {
+	r.l.Lock()
+	r.partitions = nil
+	r.l.Unlock()
+}
+
+// Filter the addresses reachable from the given address.
+func (r *SimRouter) reachable(from string, addrs []string) []string {
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.partitions == nil || from == "" {
+		return addrs
+	}
+
+	reachable := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if r.partitions[from] == r.partitions[addr] {
+			reachable = append(reachable, addr)
+		}
+	}
+	return reachable
+}
+
+// Randomly determine whether to drop a message according to the configured
+// loss fraction.
+func (r *SimRouter) Drop() bool {
+	return r.Loss > 0 && r.Float64() < r.Loss
+}
+
+// Generate a uniformly distributed random number in [0.0, 1.0).
+func (r *SimRouter) Float64() float64 {
+
+	// rand is not concurrent
+	r.l.Lock()
+	x := r.Rand.Float64()
+	r.l.Unlock()
+
+	return x
+}
+
 // Generate a normally distributed time delay with a mean of NetDelay and
 // standard deviation of NetStdDev.
 func (r *SimRouter) Delay() time.Duration {
@@ -0,0 +1,967 @@
+package swim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A duration that is written in JSON as a string such as "1.5s" or as an
+// integer number of nanoseconds.
+type SimDuration time.Duration
+
+// Implementation of json.Unmarshaler.
+func (d *SimDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		v, err := time.ParseDuration(s)
+		*d = SimDuration(v)
+		return err
+	}
+	var n int64
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*d = SimDuration(n)
+	return nil
+}
+
+// Implementation of json.Marshaler.
+func (d SimDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// A scenario declaratively describes a simulation: the group to start, a
+// timeline of actions to take after the group reaches steady state, and
+// the assertions to check at the end.
+type SimScenario struct {
+	Name       string           `json:"name"`
+	Nodes      uint             `json:"nodes"`     // Number of nodes to start
+	Detector   SimDetectorSpec  `json:"detector"`  // Detector parameters
+	Selection  SimSelectionSpec `json:"selection"` // Selection list parameters
+	Codec      string           `json:"codec"`     // gob, flate (default), or lz4
+	Network    SimNetworkSpec   `json:"network"`   // Network model
+	Warmup     SimDuration      `json:"warmup"`    // Time limit to reach steady state
+	Duration   SimDuration      `json:"duration"`  // Time to run after steady state
+	Timeline   []SimAction      `json:"timeline"`
+	Assertions []SimAssertion   `json:"assertions"`
+}
+
+// Detector parameters for a scenario. Zero values are replaced with the
+// simulator defaults.
+type SimDetectorSpec struct {
+	DirectProbes    uint        `json:"direct_probes"`
+	MaxDirectProbes uint        `json:"max_direct_probes"`
+	IndirectProbes  uint        `json:"indirect_probes"`
+	ProbeInterval   SimDuration `json:"probe_interval"`
+	ProbeTimeout    SimDuration `json:"probe_timeout"`
+	RetransmitMult  uint        `json:"retransmit_mult"`
+	SuspicionMult   uint        `json:"suspicion_mult"`
+	PackBroadcasts  bool        `json:"pack_broadcasts"`
+	GossipInterval  SimDuration `json:"gossip_interval"`
+	GossipNodes     uint        `json:"gossip_nodes"`
+	DigestInterval  SimDuration `json:"digest_interval"`
+	TraceBroadcasts bool        `json:"trace_broadcasts"`
+}
+
+// Selection list parameters for a scenario. A StaleList is used if List is
+// stale. Otherwise, a ShuffleList is used when K is at most one, or a
+// BucketList with the named sorter, re-sorting every Resort selections if
+// not zero. The coordinate sorter enables network coordinates. The topology
+// sorter uses the zone and rack labels of the network model, one bucket per
+// tier.
+type SimSelectionSpec struct {
+	List   string `json:"list"` // shuffle (default) or stale
+	K      uint   `json:"k"`
+	Sorter string `json:"sorter"` // ring (default), xor, finger, latency, coordinate, or topology
+	Resort uint   `json:"resort"`
+}
+
+// Network model for a scenario. Zero values are replaced with the
+// simulator defaults.
+type SimNetworkSpec struct {
+	Delay         SimDuration `json:"delay"`
+	StdDev        SimDuration `json:"stddev"`
+	Loss          float64     `json:"loss"`
+	MaxMessageLen int         `json:"max_message_len"`
+	Zones         uint        `json:"zones"`      // Number of zones, assigned round-robin
+	Racks         uint        `json:"racks"`      // Number of racks per zone
+	ZoneDelay     SimDuration `json:"zone_delay"` // Additional delay between zones
+}
+
+// An action taken at a time after the group reaches steady state. Nodes are
+// identified by their index from zero to the number of nodes.
+//
+//	kill       crash the nodes
+//	leave      gracefully remove the nodes
+//	partition  split the network into the groups of nodes
+//	heal       heal the network partition
+//	slow       delay the processing of each message received by the nodes by
+//	           Delay, or restore if zero
+//	pause      pause the nodes for Delay every Interval, or restore if zero
+//	drop       drop the Fraction of messages sent by the nodes
+//	broadcast  broadcast a user event with Data from the first node
+type SimAction struct {
+	At       SimDuration `json:"at"`
+	Action   string      `json:"action"`
+	Nodes    []int       `json:"nodes,omitempty"`
+	Groups   [][]int     `json:"groups,omitempty"`
+	Delay    SimDuration `json:"delay,omitempty"`
+	Interval SimDuration `json:"interval,omitempty"`
+	Fraction float64     `json:"fraction,omitempty"`
+	Data     string      `json:"data,omitempty"`
+}
+
+// An assertion checked at the end of a scenario.
+//
+//	converged        the views of all live nodes match the live set, within
+//	                 the time limit of the last action if given
+//	detected         all live nodes marked the killed and departed nodes as
+//	                 dead, within the time limit of the departure if given
+//	no_false_deaths  live nodes declared other live nodes dead at most Max
+//	                 times
+//	no_faulty_deaths live nodes declared live but faulty nodes dead at most
+//	                 Max times
+//	delivered        all live nodes received the user broadcasts, within
+//	                 the time limit of the broadcast if given
+//	log_hops         the traced user broadcasts reached the live nodes in at
+//	                 most Max times log2(N) hops, where Max defaults to 2
+type SimAssertion struct {
+	Check  string      `json:"check"`
+	Within SimDuration `json:"within,omitempty"`
+	Max    int         `json:"max,omitempty"`
+}
+
+// The outcome of checking an assertion.
+type SimAssertionResult struct {
+	SimAssertion
+	Pass   bool
+	Detail string
+}
+
+// The result of running a scenario.
+type SimScenarioResult struct {
+	Scenario   *SimScenario
+	Assertions []SimAssertionResult
+	Metrics    map[string]float64
+	Curves     []SimInfectionCurve
+}
+
+// The spread of a user broadcast through the live nodes, for plotting
+// infection curves.
+type SimInfectionCurve struct {
+	Nodes    int             // Number of live nodes other than the origin
+	Receipts []time.Duration // Times from the broadcast to each receipt, in order
+	Hops     []uint          // Hop counts of the receipts, or 0 if not traced
+}
+
+// Determine if all assertions passed.
+func (r *SimScenarioResult) Passed() bool {
+	for _, a := range r.Assertions {
+		if !a.Pass {
+			return false
+		}
+	}
+	return true
+}
+
+// Load a scenario from a JSON file.
+func LoadSimScenario(path string) (*SimScenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(SimScenario)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Check the scenario for errors and fill in default values.
+func (s *SimScenario) Validate() error {
+	if s.Nodes < 2 {
+		return errors.New("scenario needs at least two nodes")
+	}
+	if s.Warmup < 0 || s.Duration < 0 {
+		return errors.New("scenario durations must not be negative")
+	}
+
+	if s.Detector.DirectProbes == 0 {
+		s.Detector.DirectProbes = 1
+	}
+	if s.Detector.IndirectProbes == 0 {
+		s.Detector.IndirectProbes = 3
+	}
+	if s.Detector.ProbeInterval == 0 {
+		s.Detector.ProbeInterval = SimDuration(1000 * time.Millisecond)
+	}
+	if s.Detector.ProbeTimeout == 0 {
+		s.Detector.ProbeTimeout = SimDuration(300 * time.Millisecond)
+	}
+	if s.Detector.RetransmitMult == 0 {
+		s.Detector.RetransmitMult = 4
+	}
+	if s.Detector.SuspicionMult == 0 {
+		s.Detector.SuspicionMult = 5
+	}
+	if s.Network.Delay == 0 {
+		s.Network.Delay = SimDuration(kNetDelay)
+		s.Network.StdDev = SimDuration(kNetStdDev)
+	}
+	if s.Network.MaxMessageLen == 0 {
+		s.Network.MaxMessageLen = kMaxMessageLen
+	}
+	if s.Warmup == 0 {
+		s.Warmup = SimDuration(time.Minute)
+	}
+
+	switch s.Selection.List {
+	case "", "shuffle", "stale":
+	default:
+		return fmt.Errorf("unknown selection list %q", s.Selection.List)
+	}
+	if _, err := simSorter(s.Selection.Sorter); err != nil {
+		return err
+	}
+	if _, err := simCodec(s.Codec); err != nil {
+		return err
+	}
+
+	// order the timeline
+	sort.SliceStable(s.Timeline, func(i, j int) bool {
+		return s.Timeline[i].At < s.Timeline[j].At
+	})
+
+	node := func(i int) error {
+		if i < 0 || i >= int(s.Nodes) {
+			return fmt.Errorf("node %d out of range", i)
+		}
+		return nil
+	}
+
+	for _, a := range s.Timeline {
+		if a.At < 0 || a.Delay < 0 || a.Interval < 0 {
+			return fmt.Errorf("%s action durations must not be negative", a.Action)
+		}
+		switch a.Action {
+		case "kill", "leave", "slow", "pause", "drop", "broadcast":
+			if len(a.Nodes) == 0 {
+				return fmt.Errorf("%s action needs nodes", a.Action)
+			}
+			for _, i := range a.Nodes {
+				if err := node(i); err != nil {
+					return err
+				}
+			}
+		case "partition":
+			if len(a.Groups) == 0 {
+				return errors.New("partition action needs groups")
+			}
+			for _, group := range a.Groups {
+				for _, i := range group {
+					if err := node(i); err != nil {
+						return err
+					}
+				}
+			}
+		case "heal":
+		default:
+			return fmt.Errorf("unknown action %q", a.Action)
+		}
+	}
+
+	for i, a := range s.Assertions {
+		if a.Within < 0 {
+			return fmt.Errorf("%s assertion time limit must not be negative", a.Check)
+		}
+		switch a.Check {
+		case "converged", "detected", "no_false_deaths", "no_faulty_deaths",
+			"delivered":
+		case "log_hops":
+			if a.Max == 0 {
+				s.Assertions[i].Max = 2
+			}
+		default:
+			return fmt.Errorf("unknown assertion %q", a.Check)
+		}
+	}
+
+	// run for a while after the last action by default
+	if s.Duration == 0 {
+		s.Duration = SimDuration(30 * time.Second)
+		if n := len(s.Timeline); n > 0 {
+			s.Duration += s.Timeline[n-1].At
+		}
+	}
+
+	return nil
+}
+
+func simSorter(name string) (Sorter, error) {
+	switch name {
+	case "", "ring":
+		return RingSorter, nil
+	case "xor":
+		return XorSorter, nil
+	case "finger":
+		return FingerSorter, nil
+	case "latency":
+		return LatencySorter, nil
+	case "coordinate":
+		// created for each detector
+		return nil, nil
+	case "topology":
+		return TopologySorter(simLabels), nil
+	default:
+		return nil, fmt.Errorf("unknown sorter %q", name)
+	}
+}
+
+// Get the zone and rack labels of a simulated node.
+func simLabels(node *Node) []string {
+	labels, _ := node.UserData.([]string)
+	return labels
+}
+
+func simCodec(name string) (Codec, error) {
+	switch name {
+	case "", "flate":
+		return &FlateCodec{new(GobCodec)}, nil
+	case "gob":
+		return new(GobCodec), nil
+	case "lz4":
+		return &LZ4Codec{new(GobCodec)}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+// Run simulations described by scenarios.
+type SimScenarioRunner struct {
+	Logger   *log.Logger
+	Interval time.Duration // Time between samples of the membership views
+	Seed     int64         // Seed for all random choices
+	l        sync.Mutex
+	rand     *rand.Rand
+
+	scenario    *SimScenario
+	router      *SimRouter
+	nodes       []*Detector
+	live        map[uint64]bool
+	departures  map[uint64]time.Time
+	deaths      map[uint64]map[uint64]time.Time
+	falseDeaths int
+	faulty      map[uint64]time.Time
+	faultTime   time.Duration
+	faultDeaths map[uint64]int
+	sent        map[Seq]time.Time
+	origins     map[Seq]uint64
+	receipts    map[Seq]map[uint64]time.Time
+	hops        map[Seq]map[uint64]uint
+	converged   time.Time
+	messages    uint64    // Messages sent before the timeline
+	crossZone   uint64    // Messages sent between zones before the timeline
+	started     time.Time // Time the timeline started
+	done        chan struct{}
+}
+
+func NewSimScenarioRunner() *SimScenarioRunner {
+	return &SimScenarioRunner{
+		Interval: 100 * time.Millisecond,
+		Seed:     time.Now().UnixNano(),
+	}
+}
+
+// Run the scenario, returning an error only if the group could not reach
+// steady state before the timeline starts.
+func (r *SimScenarioRunner) Run(s *SimScenario) (*SimScenarioResult, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.l.Lock()
+	r.scenario = s
+	r.rand = rand.New(rand.NewSource(r.Seed))
+	r.router = NewSimRouterWithSeed(r.rand.Int63())
+	r.router.NetDelay = time.Duration(s.Network.Delay)
+	r.router.NetStdDev = time.Duration(s.Network.StdDev)
+	r.router.Loss = s.Network.Loss
+	r.router.MaxMessageLen = s.Network.MaxMessageLen
+	r.router.ZoneDelay = time.Duration(s.Network.ZoneDelay)
+	r.nodes = nil
+	r.live = make(map[uint64]bool)
+	r.done = make(chan struct{})
+	r.reset()
+	r.start()
+	r.l.Unlock()
+	defer r.stop()
+
+	// wait for steady state
+	for deadline := time.Now().Add(time.Duration(s.Warmup)); ; {
+		r.l.Lock()
+		agree := r.agree()
+		r.l.Unlock()
+		if agree {
+			break
+		} else if time.Now().After(deadline) {
+			return nil, errors.New("group did not reach steady state during warmup")
+		}
+		time.Sleep(r.Interval)
+	}
+
+	if r.Logger != nil {
+		r.Logger.Println("S TIMELINE")
+	}
+
+	r.l.Lock()
+	r.reset()
+	r.l.Unlock()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	t0 := time.Now()
+	last := t0
+	end := t0.Add(time.Duration(s.Duration))
+	actions := s.Timeline
+
+	for now := t0; now.Before(end); now = <-ticker.C {
+		r.l.Lock()
+
+		// take the actions that are due
+		for len(actions) > 0 && !now.Before(t0.Add(time.Duration(actions[0].At))) {
+			r.act(&actions[0], now)
+			actions = actions[1:]
+			last = now
+			r.converged = time.Time{}
+		}
+
+		// sample the views
+		if !r.agree() {
+			r.converged = time.Time{}
+		} else if r.converged.IsZero() {
+			r.converged = now
+		}
+
+		r.l.Unlock()
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	if r.Logger != nil {
+		r.Logger.Println("S CHECK")
+	}
+
+	return r.check(last), nil
+}
+
+// Clear the recorded events.
+func (r *SimScenarioRunner) reset() {
+	r.departures = make(map[uint64]time.Time)
+	r.deaths = make(map[uint64]map[uint64]time.Time)
+	r.falseDeaths = 0
+	r.faulty = make(map[uint64]time.Time)
+	r.faultTime = 0
+	r.faultDeaths = make(map[uint64]int)
+	r.sent = make(map[Seq]time.Time)
+	r.origins = make(map[Seq]uint64)
+	r.receipts = make(map[Seq]map[uint64]time.Time)
+	r.hops = make(map[Seq]map[uint64]uint)
+	r.converged = time.Time{}
+	r.messages = r.router.Sent()
+	r.crossZone = r.router.CrossZone()
+	r.started = time.Now()
+}
+
+// Start the nodes.
+func (r *SimScenarioRunner) start() {
+	addrs := []string(nil)
+	for i := uint(0); i < r.scenario.Nodes; i += 1 {
+		d := r.newDetector()
+		r.nodes = append(r.nodes, d)
+		r.live[d.LocalNode.Id] = true
+		addrs = append(addrs, d.LocalNode.Addrs...)
+	}
+
+	for _, d := range r.nodes {
+		d.Join(addrs...)
+		r.l.Unlock()
+		time.Sleep(time.Duration(r.rand.Int63n(int64(d.ProbeInterval))))
+		r.l.Lock()
+	}
+}
+
+// Close the nodes and stop watching them.
+func (r *SimScenarioRunner) stop() {
+	r.l.Lock()
+	nodes := r.nodes
+	live := r.live
+	r.live = make(map[uint64]bool)
+	r.l.Unlock()
+
+	for _, d := range nodes {
+		if live[d.LocalNode.Id] {
+			d.Close()
+		}
+	}
+	close(r.done)
+}
+
+func (r *SimScenarioRunner) newDetector() *Detector {
+	s := r.scenario
+
+	for {
+		id := uint64(r.rand.Int63())
+		if r.live[id] {
+			continue
+		}
+
+		addr := fmt.Sprintf("n%020d", id)
+		codec, _ := simCodec(s.Codec)
+
+		d := &Detector{
+			LocalNode: Node{
+				Id:    id,
+				Addrs: []string{addr},
+			},
+			DirectProbes:    s.Detector.DirectProbes,
+			MaxDirectProbes: s.Detector.MaxDirectProbes,
+			IndirectProbes:  s.Detector.IndirectProbes,
+			ProbeInterval:   time.Duration(s.Detector.ProbeInterval),
+			ProbeTimeout:    time.Duration(s.Detector.ProbeTimeout),
+			RetransmitMult:  s.Detector.RetransmitMult,
+			SuspicionMult:   s.Detector.SuspicionMult,
+			PackBroadcasts:  s.Detector.PackBroadcasts,
+			GossipInterval:  time.Duration(s.Detector.GossipInterval),
+			GossipNodes:     s.Detector.GossipNodes,
+			DigestInterval:  time.Duration(s.Detector.DigestInterval),
+			TraceBroadcasts: s.Detector.TraceBroadcasts,
+			Transport:       r.router.NewTransport(addr),
+			Codec:           codec,
+			Logger:          r.Logger,
+			UpdateCh:        make(chan Node, 1),
+			MessageCh:       make(chan Message, 1),
+		}
+
+		if s.Detector.TraceBroadcasts {
+			d.TraceCh = make(chan BroadcastTrace, 1)
+		}
+
+		// place the node in a zone and rack, round-robin
+		if zones := s.Network.Zones; zones > 0 {
+			i := uint(len(r.nodes))
+			zone := fmt.Sprintf("zone %d", i%zones)
+			rack := "rack 0"
+			if s.Network.Racks > 0 {
+				rack = fmt.Sprintf("rack %d", i/zones%s.Network.Racks)
+			}
+			d.LocalNode.UserData = []string{zone, rack}
+			r.router.SetZone(addr, zone)
+		}
+
+		if s.Selection.List == "stale" {
+			d.SelectionList = &StaleList{Rand: rand.New(rand.NewSource(r.rand.Int63()))}
+		} else if s.Selection.K <= 1 {
+			d.SelectionList = &ShuffleList{Rand: rand.New(rand.NewSource(r.rand.Int63()))}
+		} else {
+			sorter, _ := simSorter(s.Selection.Sorter)
+			if sorter == nil {
+				d.Coordinates = true
+				sorter = d.CoordinateSorter()
+			}
+			list := &BucketList{
+				K:           s.Selection.K,
+				Sort:        sorter,
+				LocalNode:   &d.LocalNode,
+				Rand:        rand.New(rand.NewSource(r.rand.Int63())),
+				ResortEvery: s.Selection.Resort,
+			}
+			if s.Selection.Sorter == "topology" {
+				list.Tier = TopologyTier
+			}
+			d.SelectionList = list
+		}
+
+		go r.watch(d)
+
+		return d
+	}
+}
+
+// Record the deaths declared and the user events received by the node.
+func (r *SimScenarioRunner) watch(d *Detector) {
+	id := d.LocalNode.Id
+
+	for {
+		select {
+		case <-r.done:
+			return
+
+		case node := <-d.UpdateCh:
+			if node.State != Dead {
+				continue
+			}
+			r.l.Lock()
+			if r.deaths[node.Id] == nil {
+				r.deaths[node.Id] = make(map[uint64]time.Time)
+			}
+			if _, ok := r.deaths[node.Id][id]; !ok {
+				r.deaths[node.Id][id] = time.Now()
+			}
+			if r.live[id] && r.live[node.Id] {
+				if r.Logger != nil {
+					r.Logger.Printf("S FALSE DEATH %v by %v", node.Id, id)
+				}
+				r.falseDeaths += 1
+				if _, ok := r.faulty[node.Id]; ok {
+					r.faultDeaths[node.Id] += 1
+				}
+			}
+			r.l.Unlock()
+
+		case msg := <-d.MessageCh:
+			for _, event := range msg.Events() {
+				event, ok := event.(UserEvent)
+				if !ok {
+					continue
+				}
+				r.l.Lock()
+				if receipts := r.receipts[event.Incarnation]; receipts != nil {
+					if _, ok := receipts[id]; !ok {
+						receipts[id] = time.Now()
+					}
+				}
+				r.l.Unlock()
+			}
+
+		case trace := <-d.TraceCh:
+			event, ok := trace.Event.(*UserEvent)
+			if !ok {
+				continue
+			}
+			r.l.Lock()
+			if hops := r.hops[event.Incarnation]; hops != nil {
+				if _, ok := hops[id]; !ok {
+					hops[id] = trace.Hops
+				}
+			}
+			r.l.Unlock()
+		}
+	}
+}
+
+// Take an action.
+func (r *SimScenarioRunner) act(a *SimAction, now time.Time) {
+	if r.Logger != nil {
+		r.Logger.Printf("S ACTION %s %v %v", a.Action, a.Nodes, a.Groups)
+	}
+
+	switch a.Action {
+	case "kill", "leave":
+		for _, i := range a.Nodes {
+			d := r.nodes[i]
+			if !r.live[d.LocalNode.Id] {
+				continue
+			}
+			delete(r.live, d.LocalNode.Id)
+			r.departures[d.LocalNode.Id] = now
+
+			// don't block the watchers while closing
+			r.l.Unlock()
+			if a.Action == "leave" {
+				d.Leave()
+			}
+			d.Close()
+			r.l.Lock()
+		}
+
+	case "partition":
+		groups := make([][]string, len(a.Groups))
+		for i, group := range a.Groups {
+			for _, j := range group {
+				groups[i] = append(groups[i], r.nodes[j].LocalNode.Addrs...)
+			}
+		}
+		r.router.Partition(groups...)
+
+	case "heal":
+		r.router.Heal()
+
+	case "slow", "pause", "drop":
+		for _, i := range a.Nodes {
+			r.fault(r.nodes[i], a, now)
+		}
+
+	case "broadcast":
+		d := r.nodes[a.Nodes[0]]
+		if !r.live[d.LocalNode.Id] {
+			return
+		}
+		seq := Seq(len(r.sent) + 1)
+		r.sent[seq] = now
+		r.origins[seq] = d.LocalNode.Id
+		r.receipts[seq] = make(map[uint64]time.Time)
+		r.hops[seq] = make(map[uint64]uint)
+		d.Broadcast(&UserEvent{From: d.LocalNode.Id, Incarnation: seq, Data: a.Data})
+	}
+}
+
+// Inject or remove a fault, keeping track of the time spent faulty.
+func (r *SimScenarioRunner) fault(d *Detector, a *SimAction, now time.Time) {
+	t := r.router.Routes[d.LocalNode.Addrs[0]]
+	fault := t.Fault()
+
+	switch a.Action {
+	case "slow":
+		fault.RecvDelay = time.Duration(a.Delay)
+	case "pause":
+		fault.PauseInterval = time.Duration(a.Interval)
+		fault.PauseDuration = time.Duration(a.Delay)
+	case "drop":
+		fault.DropOutbound = a.Fraction
+	}
+	t.SetFault(fault)
+
+	id := d.LocalNode.Id
+	since, faulty := r.faulty[id]
+	if fault == (SimFault{}) {
+		if faulty {
+			r.faultTime += now.Sub(since)
+			delete(r.faulty, id)
+		}
+	} else if !faulty {
+		r.faulty[id] = now
+	}
+}
+
+// Determine if the views of all live nodes match the live set.
+func (r *SimScenarioRunner) agree() bool {
+	for _, d := range r.nodes {
+		if !r.live[d.LocalNode.Id] {
+			continue
+		}
+		members := d.Members()
+		if len(members)+1 != len(r.live) {
+			return false
+		}
+		for _, node := range members {
+			if !r.live[node.Id] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Collect the receipts of the user broadcast by the live nodes in order.
+func (r *SimScenarioRunner) curve(seq Seq) SimInfectionCurve {
+	curve := SimInfectionCurve{}
+	type receipt struct {
+		t    time.Duration
+		hops uint
+	}
+	receipts := []receipt(nil)
+	for id := range r.live {
+		if id == r.origins[seq] {
+			continue
+		}
+		curve.Nodes += 1
+		if t, ok := r.receipts[seq][id]; ok {
+			receipts = append(receipts, receipt{t.Sub(r.sent[seq]), r.hops[seq][id]})
+		}
+	}
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].t < receipts[j].t })
+	for _, rt := range receipts {
+		curve.Receipts = append(curve.Receipts, rt.t)
+		curve.Hops = append(curve.Hops, rt.hops)
+	}
+	return curve
+}
+
+// Get the time for the broadcast to reach the given fraction of the nodes.
+func (c *SimInfectionCurve) infected(fraction float64) (time.Duration, bool) {
+	i := int(math.Ceil(fraction*float64(c.Nodes))) - 1
+	if i < 0 {
+		return 0, true
+	} else if i >= len(c.Receipts) {
+		return 0, false
+	}
+	return c.Receipts[i], true
+}
+
+// Check the assertions and collect the metrics.
+func (r *SimScenarioRunner) check(last time.Time) *SimScenarioResult {
+	res := &SimScenarioResult{
+		Scenario: r.scenario,
+		Metrics:  make(map[string]float64),
+	}
+
+	res.Metrics["live_nodes"] = float64(len(r.live))
+	messages := float64(r.router.Sent() - r.messages)
+	res.Metrics["messages"] = messages
+	res.Metrics["messages_per_node_s"] =
+		messages / float64(r.scenario.Nodes) / time.Since(r.started).Seconds()
+	res.Metrics["false_deaths"] = float64(r.falseDeaths)
+
+	// messages between zones
+	if r.scenario.Network.Zones > 1 {
+		crossZone := float64(r.router.CrossZone() - r.crossZone)
+		res.Metrics["cross_zone_messages"] = crossZone
+		res.Metrics["cross_zone_fraction"] = crossZone / messages
+	}
+
+	// false deaths of live but faulty nodes
+	faultDeaths := 0
+	for _, n := range r.faultDeaths {
+		faultDeaths += n
+	}
+	faultTime := r.faultTime
+	now := time.Now()
+	for id, since := range r.faulty {
+		if r.live[id] {
+			faultTime += now.Sub(since)
+		}
+	}
+	if faultTime > 0 {
+		res.Metrics["faulty_false_deaths"] = float64(faultDeaths)
+		res.Metrics["faulty_declared_dead"] = float64(len(r.faultDeaths))
+		res.Metrics["faulty_deaths_per_min"] = float64(faultDeaths) / faultTime.Minutes()
+	}
+
+	// convergence after the last action
+	converged := !r.converged.IsZero()
+	convergence := time.Duration(0)
+	if converged {
+		convergence = r.converged.Sub(last)
+		res.Metrics["convergence_s"] = convergence.Seconds()
+	}
+
+	// detection of departed nodes by all live nodes
+	undetected := 0
+	detection := time.Duration(0)
+	detectionSum := time.Duration(0)
+	for id, t := range r.departures {
+		for observer := range r.live {
+			if dt, ok := r.deaths[id][observer]; !ok {
+				undetected += 1
+			} else {
+				if dt.Sub(t) > detection {
+					detection = dt.Sub(t)
+				}
+				detectionSum += dt.Sub(t)
+			}
+		}
+	}
+	if n := len(r.departures)*len(r.live) - undetected; n > 0 {
+		res.Metrics["detection_max_s"] = detection.Seconds()
+		res.Metrics["detection_mean_s"] = (detectionSum / time.Duration(n)).Seconds()
+	}
+
+	// delivery of user broadcasts to all live nodes
+	undelivered := 0
+	delivery := time.Duration(0)
+	for seq, t := range r.sent {
+		for id := range r.live {
+			if id == r.origins[seq] {
+				continue
+			}
+			if rt, ok := r.receipts[seq][id]; !ok {
+				undelivered += 1
+			} else if rt.Sub(t) > delivery {
+				delivery = rt.Sub(t)
+			}
+		}
+	}
+	if len(r.sent) > 0 {
+		res.Metrics["delivery_max_s"] = delivery.Seconds()
+		res.Metrics["undelivered"] = float64(undelivered)
+	}
+
+	// plot the infection curves
+	seqs := []Seq(nil)
+	for seq := range r.sent {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	infected50, infected90 := time.Duration(0), time.Duration(0)
+	hopsMax, hopsSum, hopsCount := uint(0), uint(0), 0
+	for _, seq := range seqs {
+		curve := r.curve(seq)
+		res.Curves = append(res.Curves, curve)
+		if t, ok := curve.infected(0.5); ok && t > infected50 {
+			infected50 = t
+		}
+		if t, ok := curve.infected(0.9); ok && t > infected90 {
+			infected90 = t
+		}
+		for _, h := range curve.Hops {
+			if h > hopsMax {
+				hopsMax = h
+			}
+			hopsSum += h
+		}
+		if r.scenario.Detector.TraceBroadcasts {
+			hopsCount += len(curve.Hops)
+		}
+	}
+	if len(seqs) > 0 {
+		res.Metrics["infected_50_s"] = infected50.Seconds()
+		res.Metrics["infected_90_s"] = infected90.Seconds()
+	}
+	if hopsCount > 0 {
+		res.Metrics["hops_max"] = float64(hopsMax)
+		res.Metrics["hops_mean"] = float64(hopsSum) / float64(hopsCount)
+		res.Metrics["log2_nodes"] = math.Log2(float64(r.scenario.Nodes))
+	}
+
+	within := func(a SimAssertion, missing int, d time.Duration) (bool, string) {
+		if missing > 0 {
+			return false, fmt.Sprintf("%d missing after %v", missing, d)
+		} else if a.Within > 0 && d > time.Duration(a.Within) {
+			return false, fmt.Sprintf("%v > %v", d, time.Duration(a.Within))
+		}
+		return true, d.String()
+	}
+
+	for _, a := range r.scenario.Assertions {
+		ar := SimAssertionResult{SimAssertion: a}
+		switch a.Check {
+		case "converged":
+			if converged {
+				ar.Pass, ar.Detail = within(a, 0, convergence)
+			} else {
+				ar.Detail = "never"
+			}
+		case "detected":
+			ar.Pass, ar.Detail = within(a, undetected, detection)
+		case "delivered":
+			ar.Pass, ar.Detail = within(a, undelivered, delivery)
+		case "log_hops":
+			bound := uint(a.Max) * uint(math.Ceil(math.Log2(float64(r.scenario.Nodes))))
+			ar.Pass = hopsCount > 0 && hopsMax <= bound
+			ar.Detail = fmt.Sprintf("%d hops of at most %d", hopsMax, bound)
+		case "no_false_deaths":
+			ar.Pass = r.falseDeaths <= a.Max
+			ar.Detail = fmt.Sprintf("%d false deaths", r.falseDeaths)
+		case "no_faulty_deaths":
+			ar.Pass = faultDeaths <= a.Max
+			ar.Detail = fmt.Sprintf("%d false deaths of %d faulty nodes",
+				faultDeaths, len(r.faultDeaths))
+		}
+		res.Assertions = append(res.Assertions, ar)
+	}
+
+	return res
+}
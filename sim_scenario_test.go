@@ -0,0 +1,137 @@
+package swim
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimScenarioValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario string
+		err      string // substring of the expected error, or empty if valid
+	}{
+		{"valid", `{
+			"nodes": 4,
+			"timeline": [
+				{"at": "2s", "action": "kill", "nodes": [3]},
+				{"at": "1s", "action": "partition", "groups": [[0, 1], [2]]},
+				{"at": 3000000000, "action": "heal"}
+			],
+			"assertions": [{"check": "converged"}, {"check": "log_hops"}]
+		}`, ""},
+		{"too few nodes", `{"nodes": 1}`, "at least two nodes"},
+		{"unknown action", `{
+			"nodes": 2,
+			"timeline": [{"action": "explode", "nodes": [0]}]
+		}`, `unknown action "explode"`},
+		{"action without nodes", `{
+			"nodes": 2,
+			"timeline": [{"action": "kill"}]
+		}`, "kill action needs nodes"},
+		{"partition without groups", `{
+			"nodes": 2,
+			"timeline": [{"action": "partition"}]
+		}`, "partition action needs groups"},
+		{"node index too large", `{
+			"nodes": 2,
+			"timeline": [{"action": "kill", "nodes": [2]}]
+		}`, "node 2 out of range"},
+		{"negative node index", `{
+			"nodes": 2,
+			"timeline": [{"action": "slow", "nodes": [-1], "delay": "1s"}]
+		}`, "node -1 out of range"},
+		{"group index out of range", `{
+			"nodes": 3,
+			"timeline": [{"action": "partition", "groups": [[0], [1, 3]]}]
+		}`, "node 3 out of range"},
+		{"unknown check", `{
+			"nodes": 2,
+			"assertions": [{"check": "eventually"}]
+		}`, `unknown assertion "eventually"`},
+		{"unknown selection list", `{
+			"nodes": 2,
+			"selection": {"list": "sorted"}
+		}`, `unknown selection list "sorted"`},
+		{"unknown sorter", `{
+			"nodes": 2,
+			"selection": {"sorter": "random"}
+		}`, `unknown sorter "random"`},
+		{"unknown codec", `{"nodes": 2, "codec": "zip"}`, `unknown codec "zip"`},
+		{"bad duration", `{"nodes": 2, "warmup": "1 minute"}`, "time: unknown unit"},
+		{"bad duration type", `{"nodes": 2, "duration": true}`, "cannot unmarshal"},
+		{"negative duration", `{"nodes": 2, "duration": "-1s"}`, "must not be negative"},
+		{"negative action time", `{
+			"nodes": 2,
+			"timeline": [{"at": "-1s", "action": "heal"}]
+		}`, "heal action durations must not be negative"},
+		{"negative pause", `{
+			"nodes": 2,
+			"timeline": [{"action": "pause", "nodes": [0], "delay": "1s", "interval": "-1s"}]
+		}`, "pause action durations must not be negative"},
+		{"negative time limit", `{
+			"nodes": 2,
+			"assertions": [{"check": "detected", "within": "-1s"}]
+		}`, "detected assertion time limit must not be negative"},
+	}
+
+	for _, test := range tests {
+		s := new(SimScenario)
+		err := json.Unmarshal([]byte(test.scenario), s)
+		if err == nil {
+			err = s.Validate()
+		}
+		if test.err == "" && err != nil {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Fatalf("%s: expected error containing %q got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestSimScenarioValidateDefaults(t *testing.T) {
+	s := &SimScenario{
+		Nodes: 3,
+		Timeline: []SimAction{
+			{At: SimDuration(5 * time.Second), Action: "heal"},
+			{At: SimDuration(2 * time.Second), Action: "kill", Nodes: []int{1}},
+		},
+		Assertions: []SimAssertion{{Check: "log_hops"}},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the timeline is ordered
+	if s.Timeline[0].Action != "kill" || s.Timeline[1].Action != "heal" {
+		t.Fatalf("expected ordered timeline got %v", s.Timeline)
+	}
+
+	// defaults are filled in
+	if s.Detector.DirectProbes != 1 || s.Detector.IndirectProbes != 3 {
+		t.Fatalf("expected default probes got %+v", s.Detector)
+	} else if s.Warmup != SimDuration(time.Minute) {
+		t.Fatalf("expected default warmup got %v", time.Duration(s.Warmup))
+	} else if s.Duration != SimDuration(35*time.Second) {
+		t.Fatalf("expected duration after last action got %v", time.Duration(s.Duration))
+	} else if s.Assertions[0].Max != 2 {
+		t.Fatalf("expected default log_hops max of 2 got %v", s.Assertions[0].Max)
+	}
+}
+
+func TestSimScenarioFiles(t *testing.T) {
+	paths, err := filepath.Glob("sim/scenarios/*.json")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(paths) == 0 {
+		t.Fatalf("expected scenario files")
+	}
+	for _, path := range paths {
+		if _, err := LoadSimScenario(path); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+}
@@ -2,13 +2,28 @@ package swim
 
 import (
 	"errors"
+	"sync"
+	"time"
 )
 
+// SimFault describes the faults injected into a simulated node. The zero
+// value describes a healthy node.
+type SimFault struct {
+	RecvDelay     time.Duration // Processing delay for each received message
+	PauseInterval time.Duration // Time between the starts of stop-the-world pauses
+	PauseDuration time.Duration // Length of each stop-the-world pause
+	DropOutbound  float64       // Fraction of outgoing messages to drop
+}
+
 // SimTransport implements a Transport suitable for use with the simulator.
 type SimTransport struct {
-	Router *SimRouter
-	RecvCh chan *CodedMessage
-	Closed bool
+	Addr       string
+	Router     *SimRouter
+	RecvCh     chan *CodedMessage
+	Closed     bool
+	l          sync.Mutex
+	fault      SimFault
+	faultStart time.Time
 }
 
 // Create a new SimTransport associated with the given SimRouter.
@@ -24,13 +39,53 @@ func (t *SimTransport) MaxMessageLen() int {
 	return t.Router.MaxMessageLen
 }
 
+// Inject faults into the node using this transport. Pauses are scheduled
+// from the time the fault is set. The zero value removes all faults.
+func (t *SimTransport) SetFault(fault SimFault) {
+	t.l.Lock()
+	t.fault = fault
+	t.faultStart = time.Now()
+	t.l.Unlock()
+}
+
+// Get the faults injected into the node using this transport.
+func (t *SimTransport) Fault() SimFault {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.fault
+}
+
+// Block until the end of the current stop-the-world pause, if any.
+func (t *SimTransport) pause() {
+	t.l.Lock()
+	fault, start := t.fault, t.faultStart
+	t.l.Unlock()
+
+	if fault.PauseInterval <= 0 || fault.PauseDuration <= 0 {
+		return
+	}
+	phase := time.Since(start) % fault.PauseInterval
+	if phase < fault.PauseDuration {
+		time.Sleep(fault.PauseDuration - phase)
+	}
+}
+
 // Send a message to the transports described by the addresses using the
 // SimRouter.
 func (t *SimTransport) SendTo(addr []string, message *CodedMessage) error {
 	if t.Closed {
 		return errors.New("closed")
 	}
-	return t.Router.SendTo(addr, message)
+
+	// a paused node sends nothing until it resumes
+	t.pause()
+
+	// silently drop to simulate an overloaded sender
+	if p := t.Fault().DropOutbound; p > 0 && t.Router.Float64() < p {
+		return nil
+	}
+
+	return t.Router.SendFrom(t.Addr, addr, message)
 }
 
 // Receive a message from the receiving message queue.
@@ -41,6 +96,11 @@ func (t *SimTransport) Recv() (*CodedMessage, error) {
 	if coded, ok := <-t.RecvCh; !ok {
 		return nil, errors.New("closed")
 	} else {
+		// messages queue up behind a slow or paused receiver
+		if delay := t.Fault().RecvDelay; delay > 0 {
+			time.Sleep(delay)
+		}
+		t.pause()
 		return coded, nil
 	}
 }
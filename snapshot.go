@@ -0,0 +1,170 @@
+package swim
+
+// The number of nodes in each chunk of a snapshot, and the number of shards
+// of its index.
+const kSnapshotChunk = 32
+
+// A snapshot is an immutable view of the membership of a detector at a
+// point in time, including the local node and the nodes declared dead. The
+// detector replaces its snapshot on each membership change, so that readers
+// never lock the detector. The nodes of a snapshot must not be modified.
+//
+// To avoid copying all nodes on each change, the nodes are kept in chunks
+// and the index in shards by ID, which are shared between snapshots: a
+// change copies the chunk of the changed node and, for a new node, the
+// shard of its ID, taking O(n / kSnapshotChunk) time.
+type Snapshot struct {
+	LocalNode Node   // The local node
+	Version   uint64 // Membership version of the last change in the snapshot
+
+	chunks [][]Node         // Remote nodes in the order first seen
+	index  []map[uint64]int // Position of each remote node by shard and ID
+	len    int              // Number of remote nodes
+}
+
+// A tagged user data sets the tags of a node for membership queries.
+type Tagged interface {
+	Tags() []string
+}
+
+// Get a copy of the snapshot at the given version with the remote node
+// added or replaced, and with the given local node.
+func (s *Snapshot) with(version uint64, local Node, node *Node) *Snapshot {
+	that := &Snapshot{LocalNode: local, Version: version}
+	if s != nil {
+		that.chunks = s.chunks
+		that.index = s.index
+		that.len = s.len
+	}
+	if node == nil {
+		return that
+	}
+
+	// copy on write the shard of a new node
+	i, ok := that.position(node.Id)
+	if !ok {
+		shard := node.Id % kSnapshotChunk
+		index := make([]map[uint64]int, kSnapshotChunk)
+		copy(index, that.index)
+		ids := make(map[uint64]int, len(index[shard])+1)
+		for id, j := range index[shard] {
+			ids[id] = j
+		}
+		i = that.len
+		ids[node.Id] = i
+		index[shard] = ids
+		that.index = index
+		that.len += 1
+	}
+
+	// copy on write the chunk of the node
+	c, j := i/kSnapshotChunk, i%kSnapshotChunk
+	chunks := make([][]Node, len(that.chunks), len(that.chunks)+1)
+	copy(chunks, that.chunks)
+	if c == len(chunks) {
+		chunks = append(chunks, nil)
+	}
+	chunk := make([]Node, len(chunks[c]), kSnapshotChunk)
+	copy(chunk, chunks[c])
+	if j == len(chunk) {
+		chunk = append(chunk, *node)
+	} else {
+		chunk[j] = *node
+	}
+	chunks[c] = chunk
+
+	that.chunks = chunks
+	return that
+}
+
+// Get the position of the remote node with the given ID.
+func (s *Snapshot) position(id uint64) (int, bool) {
+	if s.index == nil {
+		return 0, false
+	}
+	i, ok := s.index[id%kSnapshotChunk][id]
+	return i, ok
+}
+
+// Get the node with the given ID, which may be the local node or a dead
+// node.
+func (s *Snapshot) Member(id uint64) (Node, bool) {
+	if s.LocalNode.Id == id && s.LocalNode.State != 0 {
+		return s.LocalNode, true
+	}
+	if i, ok := s.position(id); ok {
+		return s.chunks[i/kSnapshotChunk][i%kSnapshotChunk], true
+	}
+	return Node{}, false
+}
+
+// Get the nodes, including the local node, in any of the given states.
+func (s *Snapshot) MembersByState(states ...State) []Node {
+	return s.Filter(func(node *Node) bool {
+		for _, state := range states {
+			if node.State == state {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Get the nodes, including the local node, for which the predicate returns
+// true. The predicate must not modify the nodes.
+func (s *Snapshot) Filter(predicate func(node *Node) bool) (nodes []Node) {
+	if s.LocalNode.State != 0 && predicate(&s.LocalNode) {
+		nodes = append(nodes, s.LocalNode)
+	}
+	for _, chunk := range s.chunks {
+		for i := range chunk {
+			if predicate(&chunk[i]) {
+				nodes = append(nodes, chunk[i])
+			}
+		}
+	}
+	return
+}
+
+// Get all nodes, including the local node.
+func (s *Snapshot) Nodes() []Node {
+	return s.Filter(func(node *Node) bool { return true })
+}
+
+// Get the number of nodes, including the local node.
+func (s *Snapshot) Len() int {
+	if s.LocalNode.State != 0 {
+		return s.len + 1
+	}
+	return s.len
+}
+
+// Get a predicate that matches the nodes with all of the given tags in their
+// user data, which must be a []string or implement Tagged.
+func HasTags(tags ...string) func(node *Node) bool {
+	return func(node *Node) bool {
+		var have []string
+		switch data := node.UserData.(type) {
+		case []string:
+			have = data
+		case Tagged:
+			have = data.Tags()
+		default:
+			return len(tags) == 0
+		}
+
+		for _, tag := range tags {
+			found := false
+			for _, t := range have {
+				if t == tag {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,129 @@
+package swim
+
+import (
+	"testing"
+)
+
+type testTags []string
+
+func (t testTags) Tags() []string {
+	return t
+}
+
+func TestSnapshot(t *testing.T) {
+	var s *Snapshot
+	local := Node{Id: 1, State: Alive, UserData: []string{"zone a"}}
+
+	s1 := s.with(1, local, &Node{Id: 2, State: Alive, UserData: []string{"zone a", "rack 1"}})
+	s2 := s1.with(2, local, &Node{Id: 3, State: Suspect, UserData: testTags{"zone b"}})
+	s3 := s2.with(3, local, &Node{Id: 2, State: Dead})
+
+	// earlier snapshots are unchanged
+	if n := s1.Len(); n != 2 {
+		t.Fatalf("expected 2 nodes got %v", n)
+	} else if node, ok := s1.Member(2); !ok || node.State != Alive {
+		t.Fatalf("expected node 2 to be alive got %v", node)
+	} else if _, ok := s1.Member(3); ok {
+		t.Fatalf("expected no node 3")
+	}
+	if node, ok := s3.Member(2); !ok || node.State != Dead {
+		t.Fatalf("expected node 2 to be dead got %v", node)
+	} else if node, ok := s3.Member(1); !ok || node.Id != 1 {
+		t.Fatalf("expected the local node got %v", node)
+	} else if n := s3.Len(); n != 3 {
+		t.Fatalf("expected 3 nodes got %v", n)
+	}
+
+	testIds := func(nodes []Node, ids ...uint64) {
+		if len(nodes) != len(ids) {
+			t.Fatalf("expected %v got %v", ids, nodes)
+		}
+		for i, node := range nodes {
+			if node.Id != ids[i] {
+				t.Fatalf("expected %v got %v", ids, nodes)
+			}
+		}
+	}
+	testIds(s3.Nodes(), 1, 2, 3)
+	testIds(s3.MembersByState(Alive), 1)
+	testIds(s3.MembersByState(Alive, Suspect), 1, 3)
+	testIds(s3.MembersByState(Dead), 2)
+	testIds(s2.Filter(HasTags("zone a")), 1, 2)
+	testIds(s2.Filter(HasTags("zone a", "rack 1")), 2)
+	testIds(s2.Filter(HasTags("zone b")), 3)
+	testIds(s3.Filter(HasTags()), 1, 2, 3)
+	testIds(s3.Filter(HasTags("zone c")))
+
+	// no local node before starting
+	empty := &Snapshot{}
+	if _, ok := empty.Member(0); ok {
+		t.Fatalf("expected no nodes")
+	} else if n := empty.Len(); n != 0 {
+		t.Fatalf("expected no nodes got %v", n)
+	}
+}
+
+func TestSnapshotChunks(t *testing.T) {
+	var s *Snapshot
+	local := Node{Id: 0, State: Alive}
+
+	// span several chunks and shards
+	n := 3*kSnapshotChunk + 5
+	snapshots := make([]*Snapshot, n+1)
+	snapshots[0] = s
+	for id := 1; id <= n; id += 1 {
+		s = s.with(uint64(id), local, &Node{Id: uint64(id), State: Alive})
+		snapshots[id] = s
+	}
+
+	// update every other node
+	for id := 2; id <= n; id += 2 {
+		s = s.with(uint64(n+id), local, &Node{Id: uint64(id), State: Dead})
+	}
+
+	// earlier snapshots are unchanged
+	for v := 1; v <= n; v += 1 {
+		if l := snapshots[v].Len(); l != v+1 {
+			t.Fatalf("expected %v nodes at version %v got %v", v+1, v, l)
+		} else if node, ok := snapshots[v].Member(uint64(v)); !ok || node.State != Alive {
+			t.Fatalf("expected node %v to be alive got %v", v, node)
+		} else if _, ok := snapshots[v].Member(uint64(v + 1)); ok {
+			t.Fatalf("expected no node %v at version %v", v+1, v)
+		}
+	}
+
+	// nodes in the order first seen with the latest states
+	nodes := s.Nodes()
+	if len(nodes) != n+1 {
+		t.Fatalf("expected %v nodes got %v", n+1, len(nodes))
+	}
+	for i, node := range nodes[1:] {
+		id := uint64(i + 1)
+		expect := Alive
+		if id%2 == 0 {
+			expect = Dead
+		}
+		if node.Id != id {
+			t.Fatalf("expected node %v at %v got %v", id, i+1, node.Id)
+		} else if node.State != expect {
+			t.Fatalf("expected node %v to be %v got %v", id, expect, node.State)
+		}
+	}
+}
+
+// Replace the state of a member of a snapshot of 1000 nodes, as the detector
+// does on each membership change.
+func BenchmarkSnapshotWith1k(b *testing.B) {
+	var s *Snapshot
+	local := Node{Id: 0, State: Alive}
+	for id := uint64(1); id <= 1000; id += 1 {
+		s = s.with(id, local, &Node{Id: id, State: Alive})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		id := uint64(i%1000 + 1)
+		s = s.with(uint64(1000+i), local, &Node{Id: id, State: State(i%3 + 1)})
+	}
+}
@@ -1,13 +1,34 @@
 package swim
 
 import (
+	"reflect"
 	"sort"
 )
 
 // Sorter sorts nodes relative to a local node according to a distance
-// metric.
+// metric. Sorters store the distance in the SortValue of each node: a
+// BucketList keeps the nodes ordered by SortValue, then by successors on a
+// ring, so that it can insert each node without re-sorting the others.
 type Sorter func(nodes []*InternalNode, localNode *Node) error
 
+// Sorters whose distances depend on the other nodes, which a BucketList
+// re-sorts in full on each change.
+var relativeSorters = []Sorter{FingerSorter}
+
+// Whether the sorter is one of the relative sorters.
+func isRelativeSorter(sorter Sorter) bool {
+	if sorter == nil {
+		return false
+	}
+	p := reflect.ValueOf(sorter).Pointer()
+	for _, s := range relativeSorters {
+		if reflect.ValueOf(s).Pointer() == p {
+			return true
+		}
+	}
+	return false
+}
+
 type byId []*InternalNode
 
 func (s byId) Len() int           { return len(s) }
@@ -20,9 +41,16 @@ func (s byValue) Len() int           { return len(s) }
 func (s byValue) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s byValue) Less(i, j int) bool { return s[i].SortValue < s[j].SortValue }
 
-// Sort using the Chord finger.
+// Sort using the Chord finger. The sort values depend on the positions of
+// the other nodes, so it is a relative sorter.
 func FingerSorter(nodes []*InternalNode, localNode *Node) error {
 
+	// clear the fingers of the last sort, so that the ring positions are
+	// recalculated
+	for _, node := range nodes {
+		node.SortValue = 0
+	}
+
 	// sort into ring
 	if err := RingSorter(nodes, localNode); err != nil {
 		return err
@@ -75,3 +103,78 @@ func XorSorter(nodes []*InternalNode, localNode *Node) (err error) {
 	sort.Sort(byValue(nodes))
 	return nil
 }
+
+// Sort by the mean measured round-trip time, nearest first. Round-trip times
+// change as the nodes are probed, so the sorter should be used with a
+// BucketList that periodically re-sorts the nodes.
+func LatencySorter(nodes []*InternalNode, localNode *Node) error {
+	for _, node := range nodes {
+		node.SortValue = uint64(node.RTT.Mean())
+	}
+
+	sort.Sort(byValue(nodes))
+	return nil
+}
+
+// Get a sorter that sorts by the round-trip time estimated from the network
+// coordinates maintained by the detector, nearest first. Nodes without a
+// coordinate are sorted by their mean measured round-trip time. The sorter
+// reads the local coordinate without locking, so it must only be used by the
+// selection list of the detector.
+func (d *Detector) CoordinateSorter() Sorter {
+	return func(nodes []*InternalNode, localNode *Node) error {
+		for _, node := range nodes {
+			if d.coord.Compatible(node.Coord) {
+				node.SortValue = uint64(d.coord.DistanceTo(node.Coord))
+			} else {
+				node.SortValue = uint64(node.RTT.Mean())
+			}
+		}
+
+		sort.Sort(byValue(nodes))
+		return nil
+	}
+}
+
+// Get a sorter that sorts by topology, using the labels returned for each
+// node, ordered from the outermost to the innermost level of the topology,
+// e.g. region, zone, and rack. The distance between two nodes is the number
+// of labels of the local node not shared with the other node as a prefix, so
+// that nodes in the same rack are nearest. Nodes at the same distance are
+// sorted by successors on a ring. The distance is stored as the sort value,
+// from which TopologyTier reads it.
+func TopologySorter(labels func(node *Node) []string) Sorter {
+	return func(nodes []*InternalNode, localNode *Node) error {
+		local := labels(localNode)
+
+		for _, node := range nodes {
+			remote := labels(&node.Node)
+
+			// count the shared labels
+			shared := 0
+			for shared < len(local) && shared < len(remote) && local[shared] == remote[shared] {
+				shared += 1
+			}
+
+			node.SortValue = uint64(len(local) - shared)
+		}
+
+		// sort by distance, then by successors on a ring
+		ring := func(node *InternalNode) uint64 {
+			return uint64(int64(node.Id) - int64(localNode.Id))
+		}
+		sort.Slice(nodes, func(i, j int) bool {
+			if a, b := nodes[i].SortValue, nodes[j].SortValue; a != b {
+				return a < b
+			}
+			return ring(nodes[i]) < ring(nodes[j])
+		})
+		return nil
+	}
+}
+
+// Get the topology distance of a node sorted by a TopologySorter, for use
+// as the Tier of a BucketList.
+func TopologyTier(node *InternalNode) int {
+	return int(node.SortValue)
+}
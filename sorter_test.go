@@ -2,6 +2,7 @@ package swim
 
 import (
 	"testing"
+	"time"
 )
 
 func TestFingerSorter(t *testing.T) {
@@ -71,6 +72,97 @@ func TestXorSorter(t *testing.T) {
 	}
 }
 
+func TestLatencySorter(t *testing.T) {
+	nodes, localNode := makeTestNodes()
+	for _, node := range nodes {
+		node.RTT.Hint(time.Duration(10-node.Id) * time.Millisecond)
+	}
+	if err := LatencySorter(nodes, localNode); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []uint64{9, 6, 5, 4, 3, 2, 1}
+	actual := make([]uint64, len(expect))
+	for i, v := range nodes {
+		actual[i] = v.Id
+		if v.Id != expect[i] {
+			t.Fatalf("expected order %v got %v", expect, actual)
+		}
+	}
+
+	// latencies change
+	nodes[0].RTT.Hint(20 * time.Millisecond)
+	if err := LatencySorter(nodes, localNode); err != nil {
+		t.Fatal(err)
+	} else if nodes[len(nodes)-1].Id != 9 {
+		t.Fatalf("expected node 9 last got %v", nodes[len(nodes)-1].Id)
+	}
+}
+
+func TestCoordinateSorter(t *testing.T) {
+	nodes, localNode := makeTestNodes()
+	d := &Detector{coord: NewCoordinate()}
+	for _, node := range nodes {
+		node.RTT.Hint(time.Duration(node.Id) * time.Millisecond)
+	}
+
+	// node 6 is nearest by coordinate, node 5 has no coordinate
+	for _, node := range nodes {
+		if node.Id != 5 {
+			node.Coord = NewCoordinate()
+			node.Coord.Vec[0] = float64(node.Id) / 1000
+		}
+	}
+	nodes[0].Coord.Vec[0] = 0
+
+	if err := d.CoordinateSorter()(nodes, localNode); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []uint64{6, 1, 2, 3, 4, 5, 9}
+	actual := make([]uint64, len(expect))
+	for i, v := range nodes {
+		actual[i] = v.Id
+		if v.Id != expect[i] {
+			t.Fatalf("expected order %v got %v", expect, actual)
+		}
+	}
+}
+
+func TestTopologySorter(t *testing.T) {
+	nodes, localNode := makeTestNodes()
+	labels := map[uint64][]string{
+		8: {"us", "us-1a", "r1"},
+		1: {"us", "us-1a", "r1"},
+		2: {"us", "us-1a", "r2"},
+		3: {"us", "us-1b", "r1"},
+		4: {"eu", "eu-1a", "r1"},
+		5: {"us", "us-1a", "r1"},
+		6: {"us"},
+	}
+	sorter := TopologySorter(func(node *Node) []string {
+		return labels[node.Id]
+	})
+	if err := sorter(nodes, localNode); err != nil {
+		t.Fatal(err)
+	}
+
+	// same rack, same zone, same region, elsewhere
+	expect := []uint64{1, 5, 2, 3, 6, 9, 4}
+	tiers := []int{0, 0, 1, 2, 2, 3, 3}
+	actual := make([]uint64, len(expect))
+	for i, v := range nodes {
+		actual[i] = v.Id
+	}
+	for i, v := range nodes {
+		if v.Id != expect[i] {
+			t.Fatalf("expected order %v got %v", expect, actual)
+		} else if tier := TopologyTier(v); tier != tiers[i] {
+			t.Fatalf("expected node %v in tier %v got %v", v.Id, tiers[i], tier)
+		}
+	}
+}
+
 func makeTestNodes() ([]*InternalNode, *Node) {
 	localNode := &Node{Id: 8}
 	nodes := []*InternalNode{
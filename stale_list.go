@@ -0,0 +1,93 @@
+package swim
+
+import (
+	"math/rand"
+)
+
+// A stale list selects nodes in rounds like a ShuffleList, but prefers the
+// nodes that are suspected of failure, then the nodes that acknowledged a
+// ping the longest time ago, among the nodes not yet selected in the round.
+// Since each node is still selected once per round, at most 2n - 1
+// selections pass between two selections of any of n nodes. Nodes with the
+// same priority are selected in random order. Selecting a node takes O(n)
+// time. The methods are not safe to run concurrently.
+type StaleList struct {
+	Rand   *rand.Rand // Source of randomness, or the global source if nil
+	bucket            // Rounds of the nodes, as for a bucket of a BucketList
+}
+
+// Add nodes to the nodes not yet selected in this round.
+func (l *StaleList) Add(nodes ...*InternalNode) {
+	l.init()
+	for _, node := range nodes {
+		l.bucket.Add(node)
+	}
+}
+
+// Remove nodes from the list.
+func (l *StaleList) Remove(nodes ...*InternalNode) {
+	for _, node := range nodes {
+		l.bucket.Remove(node)
+	}
+}
+
+// Select the stalest node not yet selected in this round.
+func (l *StaleList) Next() *InternalNode {
+	l.init()
+
+	// empty case
+	rest := l.rest()
+	if len(rest) == 0 {
+		return nil
+	}
+
+	// find the stalest node
+	best := 0
+	for i := 1; i < len(rest); i += 1 {
+		if staler(rest[i], rest[best]) {
+			best = i
+		}
+	}
+
+	return l.take(best)
+}
+
+// Select a random node to ask for an indirect probe, without taking its turn
+// in the round, so that the stalest nodes are probed directly.
+func (l *StaleList) Helper() *InternalNode {
+	if len(l.nodes) == 0 {
+		return nil
+	}
+	return l.nodes[randIntn(l.Rand, len(l.nodes))]
+}
+
+// Set the list of nodes to use for the next round.
+func (l *StaleList) Replace(nodes []*InternalNode) {
+	l.nodes = nil
+	l.index = nil
+	l.next = 0
+	l.Add(nodes...)
+}
+
+// Initialize the bucket.
+func (l *StaleList) init() {
+	if l.index == nil {
+		l.index = make(map[uint64]int)
+	}
+	l.rand = l.Rand
+}
+
+// Get a list of the contained nodes. The returned list references the
+// internal slice and should not be modified.
+func (l *StaleList) List() []*InternalNode {
+	return l.nodes
+}
+
+// Determine if node a should be probed before node b: suspected nodes
+// first, then the node that acknowledged a ping the longest time ago.
+func staler(a, b *InternalNode) bool {
+	if as, bs := a.State == Suspect, b.State == Suspect; as != bs {
+		return as
+	}
+	return a.LastAckTime.Before(b.LastAckTime)
+}
@@ -0,0 +1,92 @@
+package swim
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestStaleList(t *testing.T) {
+	l := &StaleList{Rand: rand.New(rand.NewSource(1))}
+
+	if len(l.List()) != 0 {
+		t.Fatalf("expected empty list")
+	} else if l.Next() != nil {
+		t.Fatalf("expected nil next")
+	}
+
+	// nodes acked in order of their IDs
+	now := time.Now()
+	nodes := make([]*InternalNode, 8)
+	for i := range nodes {
+		nodes[i] = &InternalNode{Node: Node{Id: uint64(i + 1), State: Alive}}
+		nodes[i].LastAckTime = now.Add(time.Duration(i) * time.Second)
+	}
+	nodes[5].State = Suspect
+	l.Add(nodes...)
+	l.Add(nodes[0])
+	testListLen(t, l, 8)
+
+	// suspect first, then the oldest acks
+	expect := []uint64{6, 1, 2, 3, 4, 5, 7, 8}
+	for _, id := range expect {
+		if node := l.Next(); node.Id != id {
+			t.Fatalf("expected node %v got %v", id, node.Id)
+		}
+	}
+
+	// each node once per round, even if others are staler
+	nodes[5].State = Alive
+	seen := map[uint64]bool{}
+	for i := 0; i < 4; i += 1 {
+		node := l.Next()
+		seen[node.Id] = true
+		node.LastAckTime = now.Add(time.Minute)
+	}
+	nodes[7].LastAckTime = time.Time{}
+	for i := 0; i < 4; i += 1 {
+		node := l.Next()
+		if seen[node.Id] {
+			t.Fatalf("node %v selected twice in a round", node.Id)
+		}
+		seen[node.Id] = true
+	}
+
+	// the stalest node leads the next round
+	if node := l.Next(); node != nodes[7] {
+		t.Fatalf("expected node %v got %v", nodes[7].Id, node.Id)
+	}
+
+	// removing the selected node keeps the round
+	l.Remove(nodes[7], nodes[0])
+	testListLen(t, l, 6)
+	added := &InternalNode{Node: Node{Id: 9, State: Alive}, LastAckTime: now}
+	l.Add(added)
+	seen = map[uint64]bool{}
+	for i := 0; i < 7; i += 1 {
+		node := l.Next()
+		if seen[node.Id] || node == nodes[7] || node == nodes[0] {
+			t.Fatalf("unexpected node %v", node.Id)
+		}
+		seen[node.Id] = true
+	}
+	if !seen[added.Id] {
+		t.Fatalf("expected node %v to be selected", added.Id)
+	}
+	for id, i := range l.index {
+		if l.nodes[i].Id != id {
+			t.Fatalf("expected node %v at %v got %v", id, i, l.nodes[i].Id)
+		}
+	}
+
+	// helpers don't take a turn in the round
+	next := l.next
+	if node := l.Helper(); node == nil {
+		t.Fatalf("expected a helper")
+	} else if l.next != next {
+		t.Fatalf("expected round at %v got %v", next, l.next)
+	}
+
+	l.Replace(nodes[:2])
+	testListLen(t, l, 2)
+}
@@ -0,0 +1,53 @@
+package swim
+
+import (
+	"time"
+)
+
+// A trace carries propagation metadata with a broadcast event, for
+// measuring how fast and how far broadcasts spread through the group.
+type Trace struct {
+	Origin uint64    // ID of the node that originated the broadcast
+	Hops   uint      // Number of hops from the origin to the sending node
+	Time   time.Time // Time at the origin when the broadcast was created
+}
+
+// Create a trace for a broadcast originating from the given node.
+func NewTrace(origin uint64) *Trace {
+	return &Trace{Origin: origin, Time: time.Now()}
+}
+
+// Create the trace to send with a re-broadcast of the event carrying this
+// trace, one hop further from the origin.
+func (t *Trace) Next() *Trace {
+	if t == nil {
+		return nil
+	}
+	next := *t
+	next.Hops += 1
+	return &next
+}
+
+// A record of the first receipt of a traced broadcast.
+type BroadcastTrace struct {
+	Event  BroadcastEvent // The received broadcast event
+	Origin uint64         // ID of the node that originated the broadcast
+	Hops   uint           // Number of hops from the origin to this node
+	Sent   time.Time      // Time at the origin when the broadcast was created
+	Seen   time.Time      // Time the broadcast was first received
+}
+
+// Get the trace carried by the broadcast event, if any.
+func traceOf(event BroadcastEvent) *Trace {
+	switch event := event.(type) {
+	case *AliveEvent:
+		return event.Trace
+	case *SuspectEvent:
+		return event.Trace
+	case *DeathEvent:
+		return event.Trace
+	case *UserEvent:
+		return event.Trace
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package swim
+
+import (
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	trace := NewTrace(12)
+	if trace.Origin != 12 || trace.Hops != 0 || trace.Time.IsZero() {
+		t.Fatalf("Expected new trace from 12 got %v", trace)
+	}
+
+	next := trace.Next()
+	if next == trace {
+		t.Fatalf("Expected a copy of the trace")
+	} else if next.Origin != 12 || next.Hops != 1 || !next.Time.Equal(trace.Time) {
+		t.Fatalf("Expected next hop got %v", next)
+	} else if trace.Hops != 0 {
+		t.Fatalf("Expected trace to be unmodified")
+	}
+
+	var none *Trace
+	if none.Next() != nil {
+		t.Fatalf("Expected no trace")
+	}
+
+	if traceOf(&UserEvent{From: 1, Trace: trace}) != trace {
+		t.Fatalf("Expected trace of user event")
+	} else if traceOf(&DeathEvent{From: 1, Trace: trace}) != trace {
+		t.Fatalf("Expected trace of death event")
+	} else if traceOf(&SuspectEvent{From: 1}) != nil {
+		t.Fatalf("Expected no trace of suspect event")
+	}
+}
+
+func TestTraceCodec(t *testing.T) {
+	codec := new(GobCodec)
+	trace := &Trace{Origin: 12, Hops: 3}
+
+	msg := CodedMessage{}
+	msg.Message.AddEvent(&DeathEvent{From: 1, Id: 2, Incarnation: Seq(3), Trace: trace})
+	msg.Message.AddEvent(&DeathEvent{From: 1, Id: 4, Incarnation: Seq(5)})
+	if err := codec.Encode(&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	out := CodedMessage{Bytes: msg.Bytes}
+	if err := codec.Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	events := out.Message.Events()
+	if e := events[0].(DeathEvent); e.Trace == nil || *e.Trace != *trace {
+		t.Fatalf("Expected trace %v got %v", trace, e.Trace)
+	} else if e := events[1].(DeathEvent); e.Trace != nil {
+		t.Fatalf("Expected no trace got %v", e.Trace)
+	}
+}